@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// A Change records a detected change in a check's content, linking the
+// snapshots taken before and after.  OldSnapshotID is zero for the first
+// change recorded for a check.  Field is the name of the extraction rule that
+// changed, for checks with rules.  The line-level diff between the snapshots
+// isn't stored, since it would repeat the content of both; LoadDiff computes
+// it.
+type Change struct {
+	ID            uint64    `json:"id"`
+	CheckID       uint64    `json:"check_id"`
+	Field         string    `json:"field,omitempty"`
+	Time          time.Time `json:"time"`
+	OldSnapshotID uint64    `json:"old_snapshot_id"`
+	NewSnapshotID uint64    `json:"new_snapshot_id"`
+	OldHash       string    `json:"old_hash"`
+	NewHash       string    `json:"new_hash"`
+	Magnitude     Magnitude `json:"magnitude"`
+
+	// Stored by older versions.  Otherwise only set on changes that have
+	// just been recorded, or by LoadDiff.
+	Diff []DiffOp `json:"diff,omitempty"`
+
+	// For content checks, the values of individual matched nodes that
+	// changed; for JSON checks, the individual values that changed.
+	ValueChanges []ValueChange `json:"value_changes,omitempty"`
+	KeyChanges   []KeyChange   `json:"key_changes,omitempty"`
+
+	// For checks with numeric or keyword conditions, the conditions that
+	// held.
+	Conditions []string `json:"conditions,omitempty"`
+
+	// For feed checks, the new entry this change records.
+	Entry *FeedEntry `json:"entry,omitempty"`
+}
+
+// The kinds of change to a single extracted value.
+const (
+	ValueAdded    = "added"
+	ValueRemoved  = "removed"
+	ValueModified = "modified"
+)
+
+// A ValueChange describes a change to the value extracted from a single
+// matched node, identified by its position among the matches.
+type ValueChange struct {
+	Index int    `json:"index"`
+	Kind  string `json:"kind"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// DiffValues compares two lists of per-node values position by position.
+func DiffValues(old, new []string) []ValueChange {
+	var changes []ValueChange
+	for i := 0; i < len(old) || i < len(new); i++ {
+		switch {
+		case i >= len(new):
+			changes = append(changes, ValueChange{i, ValueRemoved, old[i], ""})
+		case i >= len(old):
+			changes = append(changes, ValueChange{i, ValueAdded, "", new[i]})
+		case old[i] != new[i]:
+			changes = append(changes, ValueChange{i, ValueModified, old[i], new[i]})
+		}
+	}
+	return changes
+}
+
+// Loads the text of the snapshots before and after the change.  The old text
+// is empty for a check's first change.
+func (ch *Change) texts(db *bolt.DB) (string, string, error) {
+	var oldText string
+	if ch.OldSnapshotID != 0 {
+		snap, err := GetSnapshot(db, ch.CheckID, ch.OldSnapshotID)
+		if err != nil {
+			return "", "", err
+		}
+		oldText = snap.Text
+	}
+
+	snap, err := GetSnapshot(db, ch.CheckID, ch.NewSnapshotID)
+	if err != nil {
+		return "", "", err
+	}
+	return oldText, snap.Text, nil
+}
+
+// Fills in the change's line-level diff, if it isn't already set, from its
+// snapshots or, for feed changes, its entry.
+func (ch *Change) LoadDiff(db *bolt.DB) error {
+	if ch.Diff != nil {
+		return nil
+	}
+	if ch.Entry != nil {
+		ch.Diff = Diff(nil, SplitLines(ch.Entry.String()))
+		return nil
+	}
+
+	oldText, newText, err := ch.texts(db)
+	if err != nil {
+		return err
+	}
+	ch.Diff = Diff(SplitLines(oldText), SplitLines(newText))
+	return nil
+}
+
+// Renders this change's diff in unified format.  The diff must have been
+// loaded.
+func (ch *Change) UnifiedDiff() string {
+	oldName := "/dev/null"
+	if ch.OldSnapshotID != 0 {
+		oldName = fmt.Sprintf("snapshot/%d", ch.OldSnapshotID)
+	}
+	newName := fmt.Sprintf("snapshot/%d", ch.NewSnapshotID)
+
+	return UnifiedDiff(ch.Diff, oldName, newName, 3)
+}
+
+// Sorts changes by ID, which is also the order they were detected in.
+type changesByID []*Change
+
+func (s changesByID) Len() int           { return len(s) }
+func (s changesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s changesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// Saves the given change, assigning it a new ID.
+func SaveChange(db *bolt.DB, change *Change) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return saveChange(tx, change)
+	})
+}
+
+func saveChange(tx *bolt.Tx, change *Change) error {
+	b, err := tx.Bucket(ChangesBucket).CreateBucketIfNotExists(KeyFor(change.CheckID))
+	if err != nil {
+		return err
+	}
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	change.ID = uint64(seq)
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(KeyFor(change.ID), data)
+}
+
+// Loads all changes for the given check, oldest first.
+func GetChanges(db *bolt.DB, checkID uint64, output *[]*Change) error {
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ChangesBucket).Bucket(KeyFor(checkID))
+		if b == nil {
+			return nil
+		}
+
+		b.ForEach(func(k, v []byte) error {
+			change := &Change{}
+			if err := json.Unmarshal(v, change); err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err,
+				}).Error("error unmarshaling json")
+				return nil
+			}
+
+			change.ID = binary.LittleEndian.Uint64(k)
+			*output = append(*output, change)
+			return nil
+		})
+		return nil
+	})
+
+	sort.Sort(changesByID(*output))
+	return err
+}
+
+// Loads a single change for the given check.
+func GetChange(db *bolt.DB, checkID, id uint64) (*Change, error) {
+	change := &Change{}
+	err := db.View(func(tx *bolt.Tx) error {
+		var data []byte
+		if b := tx.Bucket(ChangesBucket).Bucket(KeyFor(checkID)); b != nil {
+			data = b.Get(KeyFor(id))
+		}
+		if data == nil {
+			return fmt.Errorf("no such change: %d", id)
+		}
+
+		if err := json.Unmarshal(data, change); err != nil {
+			return err
+		}
+
+		change.ID = id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// The canonical names of the character sets that aren't single-byte.
+const (
+	CharsetUTF8     = "utf-8"
+	CharsetUTF16LE  = "utf-16le"
+	CharsetUTF16BE  = "utf-16be"
+	CharsetShiftJIS = "shift_jis"
+	CharsetEUCJP    = "euc-jp"
+)
+
+// Other names for the supported character sets.  Following the WHATWG
+// Encoding Standard, ISO-8859-1 and ASCII are treated as Windows-1252, which
+// is a superset of both, and ISO-8859-9 and ISO-8859-11 as Windows-1254 and
+// Windows-874.
+var charsetAliases = map[string]string{
+	"utf8":              CharsetUTF8,
+	"unicode-1-1-utf-8": CharsetUTF8,
+	"utf-16":            CharsetUTF16LE,
+	"unicode":           CharsetUTF16LE,
+	"ucs-2":             CharsetUTF16LE,
+	"unicodefffe":       CharsetUTF16BE,
+	"ascii":             "windows-1252",
+	"us-ascii":          "windows-1252",
+	"latin1":            "windows-1252",
+	"l1":                "windows-1252",
+	"iso-8859-1":        "windows-1252",
+	"cp819":             "windows-1252",
+	"ibm819":            "windows-1252",
+	"latin2":            "iso-8859-2",
+	"latin3":            "iso-8859-3",
+	"latin4":            "iso-8859-4",
+	"cyrillic":          "iso-8859-5",
+	"arabic":            "iso-8859-6",
+	"greek":             "iso-8859-7",
+	"hebrew":            "iso-8859-8",
+	"iso-8859-8-i":      "iso-8859-8",
+	"latin5":            "windows-1254",
+	"iso-8859-9":        "windows-1254",
+	"latin6":            "iso-8859-10",
+	"iso-8859-11":       "windows-874",
+	"tis-620":           "windows-874",
+	"dos-874":           "windows-874",
+	"cp874":             "windows-874",
+	"latin9":            "iso-8859-15",
+	"koi8r":             "koi8-r",
+	"koi":               "koi8-r",
+	"cskoi8r":           "koi8-r",
+	"koi8-ru":           "koi8-u",
+	"cp866":             "ibm866",
+	"866":               "ibm866",
+	"shift-jis":         CharsetShiftJIS,
+	"sjis":              CharsetShiftJIS,
+	"x-sjis":            CharsetShiftJIS,
+	"ms_kanji":          CharsetShiftJIS,
+	"csshiftjis":        CharsetShiftJIS,
+	"windows-31j":       CharsetShiftJIS,
+	"ms932":             CharsetShiftJIS,
+	"cp932":             CharsetShiftJIS,
+	"eucjp":             CharsetEUCJP,
+	"x-euc-jp":          CharsetEUCJP,
+}
+
+// Matches the variant spellings of the ISO-8859 and Windows code pages, such
+// as "iso8859-2", "iso_8859-2" and "cp1251".
+var (
+	isoCharsetPattern     = regexp.MustCompile(`^iso[-_]?8859[-_](\d+)$`)
+	windowsCharsetPattern = regexp.MustCompile(`^(?:x-)?cp(125[0-8])$`)
+)
+
+// Matches a character set declared in an HTML <meta> tag, either as
+// <meta charset="..."> or <meta http-equiv="Content-Type" content="...">, or
+// in an XML declaration.
+var (
+	metaCharsetPattern = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([-\w.:]+)`)
+	xmlCharsetPattern  = regexp.MustCompile(`^\s*<\?xml[^>]+encoding\s*=\s*["']([-\w.:]+)["']`)
+)
+
+// How much of the body is searched for a <meta> tag or XML declaration.
+const charsetSniffLength = 1024
+
+// Returns the canonical name of the character set with the given label, or
+// false if it isn't supported.
+func resolveCharset(label string) (string, bool) {
+	label = strings.ToLower(strings.TrimSpace(label))
+	if alias, ok := charsetAliases[label]; ok {
+		label = alias
+	}
+	if m := isoCharsetPattern.FindStringSubmatch(label); m != nil {
+		label = "iso-8859-" + m[1]
+		if alias, ok := charsetAliases[label]; ok {
+			label = alias
+		}
+	}
+	if m := windowsCharsetPattern.FindStringSubmatch(label); m != nil {
+		label = "windows-" + m[1]
+	}
+
+	switch label {
+	case CharsetUTF8, CharsetUTF16LE, CharsetUTF16BE, CharsetShiftJIS, CharsetEUCJP:
+		return label, true
+	}
+	_, ok := singleByteCharsets[label]
+	return label, ok
+}
+
+// DetectCharset works out the character set of a response body, looking in
+// turn at its byte order mark, the charset parameter of its Content-Type, and
+// any <meta> tag or XML declaration near the start of the body.  Bodies
+// without any of these are taken to be UTF-8 if they're valid UTF-8, and
+// Windows-1252 otherwise.  The returned name may be that of an unsupported
+// character set.
+func DetectCharset(data []byte, contentType string) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return CharsetUTF8
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return CharsetUTF16LE
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return CharsetUTF16BE
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if label, ok := params["charset"]; ok && len(label) > 0 {
+			name, _ := resolveCharset(label)
+			return name
+		}
+	}
+
+	head := data
+	if len(head) > charsetSniffLength {
+		head = head[:charsetSniffLength]
+	}
+	for _, re := range []*regexp.Regexp{metaCharsetPattern, xmlCharsetPattern} {
+		if m := re.FindSubmatch(head); m != nil {
+			name, _ := resolveCharset(string(m[1]))
+
+			// A document that can declare its own encoding in ASCII can't
+			// really be UTF-16.
+			if name == CharsetUTF16LE || name == CharsetUTF16BE {
+				name = CharsetUTF8
+			}
+			return name
+		}
+	}
+
+	if utf8.Valid(data) {
+		return CharsetUTF8
+	}
+	return "windows-1252"
+}
+
+// DecodeBody transcodes a response body to UTF-8, returning it along with the
+// name of the character set it was detected as.  Bodies in unsupported
+// character sets are returned unchanged.
+func DecodeBody(data []byte, contentType string) ([]byte, string) {
+	charset := DetectCharset(data, contentType)
+	name, ok := resolveCharset(charset)
+	if !ok {
+		log.WithField("charset", charset).Warn("unsupported character set")
+		return data, charset
+	}
+
+	switch name {
+	case CharsetUTF8:
+		return bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF}), name
+	case CharsetUTF16LE, CharsetUTF16BE:
+		return decodeUTF16(data, name == CharsetUTF16BE), name
+	case CharsetShiftJIS:
+		return decodeShiftJIS(data), name
+	case CharsetEUCJP:
+		return decodeEUCJP(data), name
+	}
+	return decodeSingleByte(data, singleByteCharsets[name]), name
+}
+
+func decodeSingleByte(data []byte, table string) []byte {
+	high := []rune(table)
+
+	var buf bytes.Buffer
+	for _, b := range data {
+		if b < 0x80 {
+			buf.WriteByte(b)
+		} else {
+			buf.WriteRune(high[b-0x80])
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeUTF16(data []byte, bigEndian bool) []byte {
+	if bigEndian {
+		data = bytes.TrimPrefix(data, []byte{0xFE, 0xFF})
+	} else {
+		data = bytes.TrimPrefix(data, []byte{0xFF, 0xFE})
+	}
+
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return []byte(string(utf16.Decode(units)))
+}
+
+var (
+	jis0208Once  sync.Once
+	jis0208Runes []rune
+)
+
+// Looks up a pointer in the JIS X 0208 index.
+func jis0208(pointer int) rune {
+	jis0208Once.Do(func() {
+		jis0208Runes = []rune(jis0208Index)
+	})
+
+	if pointer < 0 || pointer >= len(jis0208Runes) {
+		return utf8.RuneError
+	}
+	return jis0208Runes[pointer]
+}
+
+// Decodes Shift_JIS as described by the WHATWG Encoding Standard.
+func decodeShiftJIS(data []byte) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b <= 0x80:
+			buf.WriteRune(rune(b))
+
+		case b >= 0xA1 && b <= 0xDF:
+			// Half-width katakana.
+			buf.WriteRune(0xFF61 + rune(b-0xA1))
+
+		case (b >= 0x81 && b <= 0x9F) || (b >= 0xE0 && b <= 0xFC):
+			if i+1 >= len(data) {
+				buf.WriteRune(utf8.RuneError)
+				break
+			}
+			t := data[i+1]
+			if (t < 0x40 || t > 0xFC) || t == 0x7F {
+				// Leave an ASCII trail byte to be decoded by itself.
+				buf.WriteRune(utf8.RuneError)
+				if t >= 0x80 {
+					i++
+				}
+				break
+			}
+			i++
+
+			lead := int(b) - 0x81
+			if b >= 0xE0 {
+				lead = int(b) - 0xC1
+			}
+			trail := int(t) - 0x40
+			if t >= 0x80 {
+				trail = int(t) - 0x41
+			}
+			buf.WriteRune(jis0208(lead*188 + trail))
+
+		default:
+			buf.WriteRune(utf8.RuneError)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Decodes EUC-JP as described by the WHATWG Encoding Standard, except that
+// JIS X 0212 characters aren't supported and decode to U+FFFD.
+func decodeEUCJP(data []byte) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch {
+		case b < 0x80:
+			buf.WriteByte(b)
+
+		case b == 0x8E && i+1 < len(data) && data[i+1] >= 0xA1 && data[i+1] <= 0xDF:
+			// Half-width katakana.
+			buf.WriteRune(0xFF61 + rune(data[i+1]-0xA1))
+			i++
+
+		case b == 0x8F && i+2 < len(data) && data[i+1] >= 0xA1 && data[i+2] >= 0xA1:
+			buf.WriteRune(utf8.RuneError)
+			i += 2
+
+		case b >= 0xA1 && b <= 0xFE && i+1 < len(data) && data[i+1] >= 0xA1 && data[i+1] <= 0xFE:
+			buf.WriteRune(jis0208(int(b-0xA1)*94 + int(data[i+1]-0xA1)))
+			i++
+
+		default:
+			buf.WriteRune(utf8.RuneError)
+		}
+	}
+	return buf.Bytes()
+}
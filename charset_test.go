@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestResolveCharset(t *testing.T) {
+	tests := []struct {
+		label string
+		want  string
+		ok    bool
+	}{
+		{"UTF-8", CharsetUTF8, true},
+		{" utf8 ", CharsetUTF8, true},
+		{"utf-16", CharsetUTF16LE, true},
+		{"UTF-16BE", CharsetUTF16BE, true},
+		{"ISO-8859-1", "windows-1252", true},
+		{"latin1", "windows-1252", true},
+		{"us-ascii", "windows-1252", true},
+		{"iso8859-2", "iso-8859-2", true},
+		{"ISO_8859-9", "windows-1254", true},
+		{"cp1251", "windows-1251", true},
+		{"x-cp1250", "windows-1250", true},
+		{"KOI8-R", "koi8-r", true},
+		{"Shift-JIS", CharsetShiftJIS, true},
+		{"windows-31j", CharsetShiftJIS, true},
+		{"EUC-JP", CharsetEUCJP, true},
+		{"gb2312", "gb2312", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := resolveCharset(tt.label)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("resolveCharset(%q) = %q, %v, want %q, %v", tt.label, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDetectCharset(t *testing.T) {
+	tests := []struct {
+		data        string
+		contentType string
+		want        string
+	}{
+		{"\xEF\xBB\xBFhello", "text/html; charset=iso-8859-1", CharsetUTF8},
+		{"\xFF\xFEh\x00", "", CharsetUTF16LE},
+		{"\xFE\xFF\x00h", "", CharsetUTF16BE},
+		{"hello", "text/html; charset=KOI8-R", "koi8-r"},
+		{"hello", `text/html; charset="Shift_JIS"`, CharsetShiftJIS},
+		{"hello", "text/html; charset=gb2312", "gb2312"},
+		{`<meta charset="euc-jp">`, "text/html", CharsetEUCJP},
+		{`<meta http-equiv="Content-Type" content="text/html; charset=windows-1251">`, "", "windows-1251"},
+		{`<meta charset="utf-16">`, "", CharsetUTF8},
+		{`<?xml version="1.0" encoding="ISO-8859-2"?><rss/>`, "application/rss+xml", "iso-8859-2"},
+		{"caf\xC3\xA9", "text/html", CharsetUTF8},
+		{"caf\xE9", "text/html", "windows-1252"},
+		{"", "", CharsetUTF8},
+	}
+
+	for _, tt := range tests {
+		if got := DetectCharset([]byte(tt.data), tt.contentType); got != tt.want {
+			t.Errorf("DetectCharset(%q, %q) = %q, want %q", tt.data, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		data    string
+		charset string
+		want    string
+	}{
+		{"\xEF\xBB\xBFcaf\xC3\xA9", "utf-8", "café"},
+		{"caf\xE9 \x80", "windows-1252", "café €"},
+		{"\x81", "windows-1252", "�"},
+		{"\xC1\xC2", "koi8-r", "аб"},
+		{"\xB1", "iso-8859-2", "ą"},
+
+		{"\xFF\xFEh\x00i\x00", "utf-16", "hi"},
+		{"\xFE\xFF\x00h\x00i", "utf-16be", "hi"},
+		{"=\xD8\x00\xDE", "utf-16le", "😀"},
+		{"=\xD8h\x00", "utf-16le", "�h"},
+		{"h\x00i", "utf-16le", "h"},
+
+		{"\x93\xFA\x96\x7B\x8C\xEA", "shift_jis", "日本語"},
+		{"a\xB1\x81\x5B\x87\x40", "shift_jis", "aｱー①"},
+		{"\x80", "shift_jis", "\u0080"},
+		{"\x81\x20", "shift_jis", "� "},
+		{"\x81\x7F", "shift_jis", "�\x7F"},
+		{"\x93", "shift_jis", "�"},
+		{"\xA0\xFD", "shift_jis", "��"},
+
+		{"\xC6\xFC\xCB\xDC\xB8\xEC", "euc-jp", "日本語"},
+		{"\x8E\xB1", "euc-jp", "ｱ"},
+		{"\x8F\xA1\xA1x", "euc-jp", "�x"},
+		{"\xC6", "euc-jp", "�"},
+		{"\xC6a", "euc-jp", "�a"},
+		{"\x8Ea", "euc-jp", "�a"},
+	}
+
+	for _, tt := range tests {
+		got, name := DecodeBody([]byte(tt.data), "text/html; charset="+tt.charset)
+		if string(got) != tt.want {
+			t.Errorf("DecodeBody(%q) in %s = %q, want %q", tt.data, tt.charset, got, tt.want)
+		}
+		if !utf8.Valid(got) {
+			t.Errorf("DecodeBody(%q) in %s returned invalid UTF-8", tt.data, name)
+		}
+	}
+
+	// Bodies in unsupported character sets are left alone.
+	data := "\xB0\xA1"
+	got, name := DecodeBody([]byte(data), "text/html; charset=gb2312")
+	if string(got) != data || name != "gb2312" {
+		t.Errorf("DecodeBody in gb2312 = %q, %q, want the body unchanged", got, name)
+	}
+}
+
+func TestSingleByteTables(t *testing.T) {
+	for name, table := range singleByteCharsets {
+		if n := utf8.RuneCountInString(table); n != 128 {
+			t.Errorf("table for %s has %d characters, want 128", name, n)
+		}
+	}
+}
@@ -5,25 +5,98 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
 )
 
+// Returns the time zone the check's schedule is evaluated in, which is the
+// server's local zone unless the check gives its own.
+func (c *Check) Location() *time.Location {
+	if len(c.TimeZone) > 0 {
+		if loc, err := time.LoadLocation(c.TimeZone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// Returns true if scheduled runs of the check should be skipped at the given
+// time.
+func (c *Check) Suspended(now time.Time) bool {
+	return c.Paused || (c.SnoozedUntil != nil && now.Before(*c.SnoozedUntil))
+}
+
 // Helper struct for serialization.
 type Check struct {
 	ID          uint64    `json:"id"`
+	Type        string    `json:"type"`
 	URL         string    `json:"url"`
+	Mode        string    `json:"mode"`
 	Selector    string    `json:"selector"`
+	Regex       string    `json:"regex"`
+	Value       string    `json:"value"`
+	Attribute   string    `json:"attribute"`
 	Schedule    string    `json:"schedule"`
+	TimeZone    string    `json:"time_zone,omitempty"`
 	LastChecked time.Time `json:"last_checked"`
 	LastHash    string    `json:"last_hash"`
 	SeenChange  bool      `json:"seen"`
 
+	// The version of the content hashing LastHash was computed with.
+	HashVersion int `json:"hash_version,omitempty"`
+
+	// The ID of the most recent change record, or zero if there is none.
+	LastChangeID uint64 `json:"last_change_id"`
+
+	// Scheduled runs are skipped while the check is paused or snoozed.
+	// Manual updates still run.
+	Paused       bool       `json:"paused"`
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty"`
+
+	// Health tracking.  The check is considered failing once it has failed
+	// FailureThreshold times in a row; before then it's degraded.  Zero means
+	// the default of 3, and 1 means it's failing as soon as a run fails.
+	Health              string `json:"health"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error"`
+	FailureThreshold    int    `json:"failure_threshold"`
+
+	// How content checks normalise their content before hashing it.
+	Normalize NormalizeOptions `json:"normalize"`
+
+	// Whether and how the content is tracked as a number.
+	Numeric NumericOptions `json:"numeric"`
+
+	// Conditions on the content.  If there are any, a change is only
+	// reported when one of them starts or stops holding.
+	Keywords []KeywordCondition `json:"keywords,omitempty"`
+
+	// The smallest change that's reported.
+	MinChange ChangeThreshold `json:"min_change"`
+
+	// Named extraction rules.  If there are any, they're used instead of
+	// the check's own Mode, Selector, etc.
+	Rules []Rule `json:"rules,omitempty"`
+
+	// How to request the URL.
+	Fetch FetchOptions `json:"fetch"`
+
+	// How failed fetches are retried, and how many attempts have failed
+	// in a row and are being retried.
+	Retry        RetryPolicy `json:"retry"`
+	RetryAttempt int         `json:"retry_attempt,omitempty"`
+
+	// Assertions made by uptime checks.
+	Uptime UptimeOptions `json:"uptime"`
+
+	// Where to send notifications when this check changes.
+	Notifiers []NotifierConfig `json:"notifiers"`
+
 	// The last-checked date, as a string.
 	LastCheckedPretty string `json:"-"`
 
@@ -47,7 +120,30 @@ func KeyFor(id interface{}) (key []byte) {
 	return
 }
 
+// Fills in the defaults for fields that older checks may not have set.
+func (c *Check) SetDefaults() {
+	if len(c.Type) == 0 {
+		c.Type = CheckContent
+	}
+	if len(c.Mode) == 0 && c.Type == CheckContent {
+		c.Mode = ModeCSS
+	}
+	if len(c.Value) == 0 && c.Type == CheckContent {
+		c.Value = ValueText
+	}
+	for i := range c.Rules {
+		if len(c.Rules[i].Mode) == 0 && c.Type == CheckContent {
+			c.Rules[i].Mode = ModeCSS
+		}
+		if len(c.Rules[i].Value) == 0 && c.Type == CheckContent {
+			c.Rules[i].Value = ValueText
+		}
+	}
+}
+
 func (c *Check) PrepareForDisplay() {
+	c.SetDefaults()
+
 	if c.LastChecked.IsZero() {
 		c.LastCheckedPretty = "never"
 	} else {
@@ -84,70 +180,468 @@ func GetAllChecks(db *bolt.DB, output *[]*Check) error {
 	})
 }
 
-func (c *Check) Update(db *bolt.DB) {
+// Update fetches the check's URL, records a snapshot and change if the
+// selected content has changed, and saves the outcome as a run.
+func (c *Check) Update(db *bolt.DB) *Run {
 	log.WithFields(logrus.Fields{
 		"id":  c.ID,
 		"url": c.URL,
 	}).Info("updating document")
 
-	resp, err := http.Get(c.URL)
+	run := &Run{
+		CheckID: c.ID,
+		Start:   time.Now(),
+	}
+	defer c.finishRun(db, run)
+
+	if c.Retry.Enabled() {
+		run.Attempt = c.RetryAttempt + 1
+	}
+
+	resp, err := Fetch(c.URL, &c.Fetch)
+	run.ResponseTimeMs = int64(time.Since(run.Start) / time.Millisecond)
 	if err != nil {
+		run.Fail(ClassifyFetchError(err), err)
+		c.planRetry(run, 0)
 		log.WithFields(logrus.Fields{
 			"id":  c.ID,
 			"err": err.Error(),
 			"url": c.URL,
 		}).Error("error fetching check")
-		return
+		return run
+	}
+	run.StatusCode = resp.StatusCode
+
+	// A check that retries on a status treats it as an error once the
+	// retries run out, rather than recording the error page as content.
+	// Uptime checks make their own assertions about the status.
+	if c.Type != CheckUptime && c.Retry.Enabled() && c.Retry.retriesStatus(resp.StatusCode) {
+		resp.Body.Close()
+		run.Fail(ErrorStatus, fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+		c.planRetry(run, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+		log.WithFields(logrus.Fields{
+			"id":     c.ID,
+			"status": resp.StatusCode,
+			"url":    c.URL,
+		}).Error("error fetching check")
+		return run
+	}
+
+	body := &countingReader{ReadCloser: resp.Body}
+	resp.Body = body
+
+	if c.Type == CheckUptime {
+		c.Uptime.Assert(run, resp)
+		run.Bytes = body.n
+		if !run.Succeeded() {
+			log.WithFields(logrus.Fields{
+				"id":  c.ID,
+				"err": run.Error,
+			}).Error("error in check: uptime assertion failed")
+			return run
+		}
+
+		c.LastChecked = time.Now()
+		return run
 	}
 
-	doc, err := goquery.NewDocumentFromResponse(resp)
+	data, err := ioutil.ReadAll(body)
+	resp.Body.Close()
+	run.Bytes = body.n
 	if err != nil {
+		run.Fail(ClassifyFetchError(err), err)
 		log.WithFields(logrus.Fields{
 			"id":  c.ID,
 			"err": err,
-		}).Error("error parsing check")
+		}).Error("error reading check")
+		return run
+	}
+	data, run.Encoding = DecodeBody(data, resp.Header.Get("Content-Type"))
+
+	if len(c.Rules) > 0 {
+		c.updateRules(db, run, data, resp.StatusCode)
+	} else {
+		ext, err := c.Extract(data)
+		if ext != nil {
+			run.Matched = ext.Matched
+		}
+		if err != nil {
+			run.Fail(err.(*ExtractError).Class, err)
+			log.WithFields(logrus.Fields{
+				"id":       c.ID,
+				"mode":     c.Mode,
+				"selector": c.Selector,
+				"err":      err,
+			}).Error("error in check: extraction failed")
+			return run
+		}
+
+		if c.HashVersion < currentHashVersion {
+			c.rebaseline(db, ext, resp.StatusCode)
+		}
+		c.recordContent(db, run, "", ext, &c.LastHash, resp.StatusCode)
+	}
+
+	c.HashVersion = currentHashVersion
+	c.LastChecked = time.Now()
+	return run
+}
+
+// The version of the content hashing.  Before version 1, CSS and XPath checks
+// hashed the text of the selected nodes joined without a separator, rather
+// than one node per line.
+const currentHashVersion = 1
+
+// Adopts the extracted content as the baseline for a check whose hash was
+// computed by an older version of the content hashing, so that the upgrade
+// isn't reported as a change.  A snapshot is saved so that the next change is
+// diffed against content in the current format.
+func (c *Check) rebaseline(db *bolt.DB, ext *Extraction, statusCode int) {
+	if (len(c.Type) > 0 && c.Type != CheckContent) ||
+		(len(c.Mode) > 0 && c.Mode != ModeCSS && c.Mode != ModeXPath) ||
+		len(c.LastHash) == 0 {
+		return
+	}
+
+	sum := HashText(ext.Text)
+	if sum == c.LastHash {
 		return
 	}
 
-	// Get all nodes matching the given selector
-	sel := doc.Find(c.Selector)
-	if sel.Length() == 0 {
+	log.WithFields(logrus.Fields{
+		"id":       c.ID,
+		"lastHash": c.LastHash,
+		"sum":      sum,
+	}).Info("rebaselining content hashed by an older version")
+
+	snap := &Snapshot{
+		CheckID:    c.ID,
+		Time:       time.Now(),
+		Hash:       sum,
+		Text:       ext.Text,
+		HTML:       ext.HTML,
+		Values:     ext.Values,
+		StatusCode: statusCode,
+	}
+	if err := SaveSnapshot(db, snap); err != nil {
 		log.WithFields(logrus.Fields{
-			"id":       c.ID,
-			"selector": c.Selector,
-		}).Error("error in check: no nodes in selection")
+			"id":  c.ID,
+			"err": err,
+		}).Error("error saving snapshot")
+	}
+	c.LastHash = sum
+}
+
+// Records a snapshot and change for the extracted content if its hash differs
+// from lastHash, which is then updated.  Field is the name of the rule the
+// content was extracted by, or empty for checks without rules.
+func (c *Check) recordContent(db *bolt.DB, run *Run, field string, ext *Extraction, lastHash *string, statusCode int) {
+	sum := HashText(ext.Text)
+
+	// Numeric checks record every value, and checks with conditions only
+	// report a change when one of their conditions holds.  The first
+	// content is always recorded, as a baseline.
+	var held []string
+	conditional := false
+	if ext.Number != nil {
+		numeric := c.numericFor(field)
+		prev := c.recordNumber(db, field, *ext.Number)
+		held = numeric.Evaluate(prev, *ext.Number)
+		conditional = len(numeric.Conditions) > 0
+	}
+	if keywords := c.keywordsFor(field); len(keywords) > 0 {
+		held = append(held, evaluateKeywords(keywords, ext.Text)...)
+		conditional = true
+	}
+	if conditional && len(held) == 0 && len(*lastHash) > 0 {
+		*lastHash = sum
 		return
 	}
 
-	// Hash the content
+	if *lastHash == sum {
+		return
+	}
+
+	// Changes too small to report leave lastHash alone, so that the next
+	// run measures against the last reported content again.
+	if c.MinChange.Enabled() && c.Type != CheckFeed && len(held) == 0 {
+		prev, err := GetLatestSnapshot(db, c.ID, field)
+		if err == nil && prev != nil {
+			mag := MeasureChange(Diff(SplitLines(prev.Text), SplitLines(ext.Text)))
+			if c.MinChange.Ignores(mag) {
+				log.WithFields(logrus.Fields{
+					"id":           c.ID,
+					"field":        field,
+					"linesPercent": mag.LinesPercent,
+					"charsChanged": mag.CharsChanged,
+				}).Debug("ignoring change below threshold")
+				return
+			}
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"id":       c.ID,
+		"field":    field,
+		"lastHash": *lastHash,
+		"sum":      sum,
+	}).Info("document changed")
+
+	snap := &Snapshot{
+		CheckID:    c.ID,
+		Field:      field,
+		Time:       time.Now(),
+		Hash:       sum,
+		Text:       ext.Text,
+		HTML:       ext.HTML,
+		Values:     ext.Values,
+		StatusCode: statusCode,
+	}
+	if c.Type == CheckFeed {
+		changes := c.recordFeedEntries(db, snap, ext.Entries)
+		for _, change := range changes {
+			c.notifyEntry(db, change)
+		}
+
+		// Only new entries count as a change, so edits to old ones
+		// are compared against the content the last change reported.
+		if len(changes) == 0 && len(*lastHash) > 0 {
+			return
+		}
+		if len(changes) > 0 {
+			run.Changed = true
+			run.ChangeID = changes[len(changes)-1].ID
+		}
+	} else {
+		change := c.recordChange(db, snap, *lastHash, held)
+		c.notifyChange(db, field, *lastHash, change)
+
+		run.Changed = true
+		if change != nil {
+			run.ChangeID = change.ID
+		}
+	}
+
+	*lastHash = sum
+	c.SeenChange = false
+}
+
+// Returns the hex-encoded SHA-256 hash of the text, as stored in LastHash.
+func HashText(text string) string {
 	hash := sha256.New()
-	io.WriteString(hash, sel.Text())
-	sum := hex.EncodeToString(hash.Sum(nil))
+	io.WriteString(hash, text)
+	return hex.EncodeToString(hash.Sum(nil))
+}
 
-	// Check for update
-	if c.LastHash != sum {
-		log.WithFields(logrus.Fields{
-			"id":       c.ID,
-			"lastHash": c.LastHash,
-			"sum":      sum,
-		}).Info("document changed")
-		c.LastHash = sum
-		c.SeenChange = false
+// Finishes timing the run, updates the check's health from it, and saves
+// both the check and the run.  Nothing is saved if the check was deleted
+// while it ran.
+func (c *Check) finishRun(db *bolt.DB, run *Run) {
+	run.DurationMs = int64(time.Since(run.Start) / time.Millisecond)
+
+	// Only the last attempt counts towards the check's health.
+	if run.RetryAt != nil {
+		c.RetryAttempt = run.Attempt
+	} else {
+		c.RetryAttempt = 0
+		c.recordHealth(db, run)
 	}
 
-	c.LastChecked = time.Now()
+	// Need to update the database now, since we've changed (at least the
+	// health of the check).  The check may have been paused, snoozed or
+	// edited while it ran, so only the state the run owns is saved over
+	// the stored check.
+	deleted := false
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UrlsBucket)
+		data := b.Get(KeyFor(c.ID))
+		if data == nil {
+			deleted = true
+			return nil
+		}
 
-	// Need to update the database now, since we've changed (at least the last
-	// checked time).
-	err = db.Update(func(tx *bolt.Tx) error {
-		data, err := json.Marshal(c)
-		if err != nil {
+		stored := &Check{}
+		if err := json.Unmarshal(data, stored); err != nil {
 			return err
 		}
+		stored.ID = c.ID
+		stored.takeRunState(c, run)
 
-		if err = tx.Bucket(UrlsBucket).Put(KeyFor(c.ID), data); err != nil {
+		data, err := json.Marshal(stored)
+		if err != nil {
 			return err
 		}
-		return nil
+		return b.Put(KeyFor(c.ID), data)
 	})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error saving check")
+	}
+	if deleted {
+		log.WithFields(logrus.Fields{
+			"id": c.ID,
+		}).Info("not saving run for deleted check")
+		return
+	}
+
+	if err = SaveRun(db, run); err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error saving run")
+	}
+}
+
+// Copies the state that the given run updated from the copy of the check it
+// ran with, leaving the check's settings as they're stored.
+func (c *Check) takeRunState(ran *Check, run *Run) {
+	c.LastChecked = ran.LastChecked
+	c.LastHash = ran.LastHash
+	c.LastChangeID = ran.LastChangeID
+	c.HashVersion = ran.HashVersion
+	c.RetryAttempt = ran.RetryAttempt
+	if run.Changed {
+		c.SeenChange = ran.SeenChange
+	}
+
+	c.Health = ran.Health
+	c.ConsecutiveFailures = ran.ConsecutiveFailures
+	c.LastError = ran.LastError
+
+	keepKeywordStates(c.Keywords, ran.Keywords)
+	c.keepRuleHashes(ran.Rules)
+
+	// Forget a snooze once it's over.
+	if c.SnoozedUntil != nil && !run.Start.Before(*c.SnoozedUntil) {
+		c.SnoozedUntil = nil
+	}
+}
+
+// Saves the given snapshot, along with a change record diffing it against the
+// previous snapshot for this check and field.  Conditions lists the numeric
+// and keyword conditions that held, if any.  Errors are logged but otherwise ignored,
+// since failing to record history shouldn't stop the check from updating; in
+// that case, the returned change is nil.
+func (c *Check) recordChange(db *bolt.DB, snap *Snapshot, oldHash string, conditions []string) *Change {
+	prev, err := GetLatestSnapshot(db, c.ID, snap.Field)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error loading previous snapshot")
+	}
+
+	if err = SaveSnapshot(db, snap); err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error saving snapshot")
+		return nil
+	}
+
+	change := &Change{
+		CheckID:       c.ID,
+		Field:         snap.Field,
+		Time:          snap.Time,
+		NewSnapshotID: snap.ID,
+		OldHash:       oldHash,
+		NewHash:       snap.Hash,
+		Conditions:    conditions,
+	}
+
+	var oldText string
+	var oldValues []string
+	if prev != nil {
+		change.OldSnapshotID = prev.ID
+		oldText = prev.Text
+		oldValues = prev.Values
+	}
+	diff := Diff(SplitLines(oldText), SplitLines(snap.Text))
+	change.Magnitude = MeasureChange(diff)
+	change.ValueChanges = DiffValues(oldValues, snap.Values)
+
+	if c.Type == CheckJSON {
+		var oldDoc interface{}
+		if len(oldText) > 0 {
+			oldDoc, _ = decodeJSON([]byte(oldText))
+		}
+		newDoc, _ := decodeJSON([]byte(snap.Text))
+		change.KeyChanges = DiffJSON(oldDoc, newDoc)
+	}
+
+	if err = SaveChange(db, change); err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error saving change")
+		return nil
+	}
+
+	// Keep the diff for the notification, now that it's been saved
+	// without it.
+	change.Diff = diff
+	c.LastChangeID = change.ID
+	return change
+}
+
+// Sends a change notification to each of this check's notifiers.  Field is
+// the name of the rule that changed, if any.
+func (c *Check) notifyChange(db *bolt.DB, field, oldHash string, change *Change) {
+	n := &Notification{
+		Event:    "change",
+		CheckID:  c.ID,
+		URL:      c.URL,
+		Field:    field,
+		Selector: c.Selector,
+		Time:     time.Now(),
+		OldHash:  oldHash,
+	}
+	if rule := c.rule(field); rule != nil {
+		n.Selector = rule.Selector
+	}
+	if change != nil {
+		n.Time = change.Time
+		n.ChangeID = change.ID
+		n.NewHash = change.NewHash
+		n.Diff = change.UnifiedDiff()
+		n.Conditions = change.Conditions
+	}
+
+	c.notify(db, n)
+}
+
+// Sends the notification to each of this check's notifiers.  Delivery happens
+// in the background so that a slow notifier can't hold up the check.
+func (c *Check) notify(db *bolt.DB, n *Notification) {
+	if len(c.Notifiers) == 0 {
+		return
+	}
+
+	go SendNotifications(db, c.Notifiers, n)
+}
+
+// Removes the snapshots, change, delivery, run, feed entry and numeric value
+// records belonging to the given check.
+func DeleteCheckHistory(tx *bolt.Tx, id uint64) error {
+	buckets := [][]byte{
+		SnapshotsBucket,
+		ChangesBucket,
+		DeliveriesBucket,
+		RunsBucket,
+		FeedEntriesBucket,
+		ValuesBucket,
+		LatestBucket,
+	}
+	for _, name := range buckets {
+		b := tx.Bucket(name)
+		if b.Bucket(KeyFor(id)) == nil {
+			continue
+		}
+		if err := b.DeleteBucket(KeyFor(id)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Config holds the server-wide settings.  Settings are read from a JSON
+// config file, then environment variables, then command-line flags, with
+// later sources taking precedence.
+type Config struct {
+	DBPath string `json:"db_path"`
+
+	// The address to listen on, in any format understood by goji's bind
+	// package.  If empty, goji picks a default based on its environment.
+	Bind string `json:"bind"`
+
+	LogLevel  string `json:"log_level"`
+	LogFormat string `json:"log_format"`
+
+	// Defaults for checks that don't specify their own fetch options.
+	FetchTimeout string `json:"fetch_timeout"`
+	UserAgent    string `json:"user_agent"`
+
+	// The maximum number of scheduled checks that may run at once, overall
+	// and against any one host.
+	MaxConcurrentChecks int `json:"max_concurrent_checks"`
+	MaxChecksPerHost    int `json:"max_checks_per_host"`
+
+	// The minimum time between starting two checks against the same host, as
+	// a duration string.
+	HostInterval string `json:"host_interval"`
+
+	// How long to wait between queueing each check at startup, as a duration
+	// string, so that a restart doesn't fetch every page at once.
+	StartupStagger string `json:"startup_stagger"`
+
+	// The commands that exec notifiers may run, matched exactly against a
+	// notifier's command.  If empty, exec notifiers are disabled.
+	ExecCommands []string `json:"exec_commands"`
+
+	// How long to keep run, delivery and log records for, as a duration
+	// string.  If empty, records are kept forever.
+	Retention string `json:"retention"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		DBPath:              "./monitor.db",
+		LogLevel:            "info",
+		LogFormat:           "text",
+		FetchTimeout:        "30s",
+		MaxConcurrentChecks: 10,
+		MaxChecksPerHost:    2,
+		HostInterval:        "1s",
+		StartupStagger:      "100ms",
+	}
+}
+
+var logLevels = map[string]logrus.Level{
+	"debug": logrus.Debug,
+	"info":  logrus.Info,
+	"warn":  logrus.Warn,
+	"error": logrus.Error,
+}
+
+func (c *Config) Validate() error {
+	if len(c.DBPath) == 0 {
+		return fmt.Errorf("db_path cannot be empty")
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		return fmt.Errorf("log_level must be one of debug, info, warn or error")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("log_format must be one of text or json")
+	}
+	if d, err := time.ParseDuration(c.FetchTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("fetch_timeout must be a positive duration")
+	}
+	if c.MaxConcurrentChecks < 1 {
+		return fmt.Errorf("max_concurrent_checks must be at least 1")
+	}
+	if c.MaxChecksPerHost < 1 {
+		return fmt.Errorf("max_checks_per_host must be at least 1")
+	}
+	if d, err := time.ParseDuration(c.HostInterval); err != nil || d < 0 {
+		return fmt.Errorf("host_interval must be a non-negative duration")
+	}
+	if d, err := time.ParseDuration(c.StartupStagger); err != nil || d < 0 {
+		return fmt.Errorf("startup_stagger must be a non-negative duration")
+	}
+	if len(c.Retention) > 0 {
+		if d, err := time.ParseDuration(c.Retention); err != nil || d <= 0 {
+			return fmt.Errorf("retention must be a positive duration")
+		}
+	}
+	return nil
+}
+
+// Returns the retention period, or zero if records are kept forever.
+func (c *Config) RetentionPeriod() time.Duration {
+	d, _ := time.ParseDuration(c.Retention)
+	return d
+}
+
+// Returns the limits for the check queue.
+func (c *Config) QueueLimits() QueueLimits {
+	interval, _ := time.ParseDuration(c.HostInterval)
+	return QueueLimits{
+		MaxConcurrent: c.MaxConcurrentChecks,
+		MaxPerHost:    c.MaxChecksPerHost,
+		HostInterval:  interval,
+	}
+}
+
+// Returns the delay between queueing each check at startup.
+func (c *Config) StartupStaggerPeriod() time.Duration {
+	d, _ := time.ParseDuration(c.StartupStagger)
+	return d
+}
+
+// Applies the logging, fetch and notifier settings to the global state.
+func (c *Config) Apply() {
+	log.Level = logLevels[c.LogLevel]
+	if c.LogFormat == "json" {
+		log.Formatter = new(logrus.JSONFormatter)
+	} else {
+		log.Formatter = new(logrus.TextFormatter)
+	}
+
+	DefaultFetchTimeout, _ = time.ParseDuration(c.FetchTimeout)
+	DefaultUserAgent = c.UserAgent
+	ExecCommands = c.ExecCommands
+}
+
+// A configSetting is a setting that can be given as a flag or environment
+// variable.  The bind setting is special, since goji registers its own flag.
+type configSetting struct {
+	Flag  string
+	Env   string
+	Usage string
+	Set   func(c *Config, v string) error
+}
+
+var configSettings = []configSetting{
+	{"db", "SITE_MONITOR_DB", "path to the database file",
+		func(c *Config, v string) error { c.DBPath = v; return nil }},
+	{"log-level", "SITE_MONITOR_LOG_LEVEL", "log level (debug, info, warn or error)",
+		func(c *Config, v string) error { c.LogLevel = v; return nil }},
+	{"log-format", "SITE_MONITOR_LOG_FORMAT", "log format (text or json)",
+		func(c *Config, v string) error { c.LogFormat = v; return nil }},
+	{"fetch-timeout", "SITE_MONITOR_FETCH_TIMEOUT", "default timeout for fetching a check",
+		func(c *Config, v string) error { c.FetchTimeout = v; return nil }},
+	{"user-agent", "SITE_MONITOR_USER_AGENT", "default User-Agent for fetching a check",
+		func(c *Config, v string) error { c.UserAgent = v; return nil }},
+	{"max-concurrent-checks", "SITE_MONITOR_MAX_CONCURRENT_CHECKS", "maximum number of checks to run at once",
+		func(c *Config, v string) (err error) {
+			c.MaxConcurrentChecks, err = strconv.Atoi(v)
+			return
+		}},
+	{"max-checks-per-host", "SITE_MONITOR_MAX_CHECKS_PER_HOST", "maximum number of checks to run at once against one host",
+		func(c *Config, v string) (err error) {
+			c.MaxChecksPerHost, err = strconv.Atoi(v)
+			return
+		}},
+	{"host-interval", "SITE_MONITOR_HOST_INTERVAL", "minimum time between starting checks against one host",
+		func(c *Config, v string) error { c.HostInterval = v; return nil }},
+	{"startup-stagger", "SITE_MONITOR_STARTUP_STAGGER", "delay between queueing each check at startup",
+		func(c *Config, v string) error { c.StartupStagger = v; return nil }},
+	{"exec-commands", "SITE_MONITOR_EXEC_COMMANDS", "comma-separated commands that exec notifiers may run (default none)",
+		func(c *Config, v string) error {
+			c.ExecCommands = nil
+			for _, command := range strings.Split(v, ",") {
+				if command = strings.TrimSpace(command); len(command) > 0 {
+					c.ExecCommands = append(c.ExecCommands, command)
+				}
+			}
+			return nil
+		}},
+	{"retention", "SITE_MONITOR_RETENTION", "how long to keep run history, e.g. 720h (default forever)",
+		func(c *Config, v string) error { c.Retention = v; return nil }},
+	{"", "SITE_MONITOR_BIND", "",
+		func(c *Config, v string) error { c.Bind = v; return nil }},
+}
+
+// LoadConfig builds the configuration from the config file, environment and
+// command-line flags.  It parses the command line, so must be called before
+// anything else looks at flags.  If printConfig is true, the caller should
+// print the configuration and exit.
+func LoadConfig() (cfg *Config, printConfig bool, err error) {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	printFlag := flag.Bool("print-config", false, "print the configuration and exit")
+
+	values := make(map[string]*string)
+	for _, s := range configSettings {
+		if len(s.Flag) > 0 {
+			values[s.Flag] = flag.String(s.Flag, "", s.Usage)
+		}
+	}
+	flag.Parse()
+
+	// Note which flags were explicitly given.
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	cfg = DefaultConfig()
+
+	path := *configPath
+	if !given["config"] {
+		path = os.Getenv("SITE_MONITOR_CONFIG")
+	}
+	if len(path) > 0 {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, false, err
+		}
+		if err = json.Unmarshal(data, cfg); err != nil {
+			return nil, false, fmt.Errorf("error parsing %s: %s", path, err)
+		}
+	}
+
+	for _, s := range configSettings {
+		if v := os.Getenv(s.Env); len(v) > 0 {
+			if err = s.Set(cfg, strings.TrimSpace(v)); err != nil {
+				return nil, false, fmt.Errorf("invalid %s: %s", s.Env, err)
+			}
+		}
+	}
+
+	for _, s := range configSettings {
+		if len(s.Flag) > 0 && given[s.Flag] {
+			if err = s.Set(cfg, *values[s.Flag]); err != nil {
+				return nil, false, fmt.Errorf("invalid -%s: %s", s.Flag, err)
+			}
+		}
+	}
+	if given["bind"] {
+		cfg.Bind = flag.Lookup("bind").Value.String()
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, false, err
+	}
+	return cfg, *printFlag, nil
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// The kinds of operations that can appear in a diff.
+const (
+	DiffEqual  = "equal"
+	DiffInsert = "insert"
+	DiffDelete = "delete"
+)
+
+// A DiffOp is a run of consecutive tokens (lines or words) that are all
+// equal, inserted or deleted.
+type DiffOp struct {
+	Kind   string   `json:"kind"`
+	Tokens []string `json:"tokens"`
+}
+
+// Splits content into lines for a line-level diff.
+func SplitLines(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// Splits content into words for a word-level diff.
+func SplitWords(s string) []string {
+	return strings.Fields(s)
+}
+
+// Diff computes the shortest edit script between the two token lists using
+// the linear-space variant of Myers' algorithm, and returns it as a list of
+// grouped operations.  Memory use is proportional to the length of the
+// input, however different the lists are.
+func Diff(a, b []string) []DiffOp {
+	max := len(a) + len(b)
+	d := &differ{
+		a:   a,
+		b:   b,
+		off: max + 1,
+		vf:  make([]int, 2*max+3),
+		vb:  make([]int, 2*max+3),
+	}
+	d.compare(0, len(a), 0, len(b))
+	return d.ops
+}
+
+// A differ holds the state of a single diff.  The forward and backward
+// vectors are shared by every level of the recursion, since each level is
+// done with them before it recurses.
+type differ struct {
+	a, b   []string
+	off    int
+	vf, vb []int
+	ops    []DiffOp
+}
+
+// Appends a token to the edit script, merging it into the previous
+// operation if it's of the same kind.
+func (d *differ) emit(kind, token string) {
+	if l := len(d.ops); l > 0 && d.ops[l-1].Kind == kind {
+		d.ops[l-1].Tokens = append(d.ops[l-1].Tokens, token)
+	} else {
+		d.ops = append(d.ops, DiffOp{Kind: kind, Tokens: []string{token}})
+	}
+}
+
+// Diffs a[aLo:aHi] against b[bLo:bHi], appending the result to the edit
+// script.
+func (d *differ) compare(aLo, aHi, bLo, bHi int) {
+	// Strip the common prefix and suffix, which are always equal runs.
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.emit(DiffEqual, d.a[aLo])
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && d.a[aHi-suffix-1] == d.b[bHi-suffix-1] {
+		suffix++
+	}
+	aHi -= suffix
+	bHi -= suffix
+
+	switch {
+	case aLo == aHi:
+		for i := bLo; i < bHi; i++ {
+			d.emit(DiffInsert, d.b[i])
+		}
+	case bLo == bHi:
+		for i := aLo; i < aHi; i++ {
+			d.emit(DiffDelete, d.a[i])
+		}
+	default:
+		x, y, u, v := d.middleSnake(aLo, aHi, bLo, bHi)
+		if (x == aLo && y == bLo && u == aLo && v == bLo) || (x == aHi && y == bHi) {
+			// Shouldn't happen, but don't recurse forever if it does.
+			for i := aLo; i < aHi; i++ {
+				d.emit(DiffDelete, d.a[i])
+			}
+			for i := bLo; i < bHi; i++ {
+				d.emit(DiffInsert, d.b[i])
+			}
+			break
+		}
+
+		d.compare(aLo, x, bLo, y)
+		for i := x; i < u; i++ {
+			d.emit(DiffEqual, d.a[i])
+		}
+		d.compare(u, aHi, v, bHi)
+	}
+
+	for i := aHi; i < aHi+suffix; i++ {
+		d.emit(DiffEqual, d.a[i])
+	}
+}
+
+// Finds the middle snake of a shortest edit script for a[aLo:aHi] and
+// b[bLo:bHi] by searching forwards from the start and backwards from the
+// end until the two searches overlap.  Returns the snake's start (x, y) and
+// end (u, v).  Both ranges must be non-empty.
+func (d *differ) middleSnake(aLo, aHi, bLo, bHi int) (x, y, u, v int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	off := d.off
+	vf, vb := d.vf, d.vb
+
+	// vf[off+k] is the furthest x reached on diagonal k going forwards, and
+	// vb[off+k] the furthest reached on diagonal k of the reversed lists,
+	// which is diagonal delta-k going forwards.
+	vf[off+1] = 0
+	vb[off+1] = 0
+
+	for D := 0; D <= (n+m+1)/2; D++ {
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || (k != D && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1]
+			} else {
+				x = vf[off+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && d.a[aLo+x] == d.b[bLo+y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+
+			if odd && delta-k >= -(D-1) && delta-k <= D-1 && x+vb[off+delta-k] >= n {
+				return aLo + x0, bLo + y0, aLo + x, bLo + y
+			}
+		}
+
+		for k := -D; k <= D; k += 2 {
+			var x int
+			if k == -D || (k != D && vb[off+k-1] < vb[off+k+1]) {
+				x = vb[off+k+1]
+			} else {
+				x = vb[off+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && d.a[aHi-1-x] == d.b[bHi-1-y] {
+				x++
+				y++
+			}
+			vb[off+k] = x
+
+			if !odd && delta-k >= -D && delta-k <= D && x+vf[off+delta-k] >= n {
+				return aHi - x, bHi - y, aHi - x0, bHi - y0
+			}
+		}
+	}
+
+	// Unreachable: the searches always meet by the middle.
+	return aLo, bLo, aLo, bLo
+}
+
+// Returns true if the diff contains anything other than equal runs.
+func DiffChanged(ops []DiffOp) bool {
+	for _, op := range ops {
+		if op.Kind != DiffEqual {
+			return true
+		}
+	}
+	return false
+}
+
+// Renders a line-level diff in unified format, with the given number of
+// lines of context around each hunk.
+func UnifiedDiff(ops []DiffOp, oldName, newName string, context int) string {
+	type line struct {
+		kind string
+		text string
+	}
+
+	var lines []line
+	for _, op := range ops {
+		for _, t := range op.Tokens {
+			lines = append(lines, line{op.Kind, t})
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+
+	// oldLine and newLine track the (0-based) position in each file of the
+	// line at index i.
+	oldLine, newLine := 0, 0
+	for i := 0; i < len(lines); {
+		if lines[i].kind == DiffEqual {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		// Found a change; back up to include leading context.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		for j := start; j < i; j++ {
+			oldLine--
+			newLine--
+		}
+
+		// Extend the hunk until we see more than 2*context equal lines in a
+		// row (or the end of input).
+		end := i
+		for run := 0; end < len(lines); end++ {
+			if lines[end].kind != DiffEqual {
+				run = 0
+				continue
+			}
+			run++
+			if run > 2*context {
+				end = end - run + 1 + context
+				break
+			}
+		}
+		if end == len(lines) {
+			// Trim trailing context down to size.
+			run := 0
+			for j := end - 1; j >= 0 && lines[j].kind == DiffEqual; j-- {
+				run++
+			}
+			if run > context {
+				end -= run - context
+			}
+		}
+
+		oldCount, newCount := 0, 0
+		for _, l := range lines[start:end] {
+			if l.kind != DiffInsert {
+				oldCount++
+			}
+			if l.kind != DiffDelete {
+				newCount++
+			}
+		}
+
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+		for _, l := range lines[start:end] {
+			switch l.kind {
+			case DiffEqual:
+				buf.WriteString(" ")
+			case DiffInsert:
+				buf.WriteString("+")
+			case DiffDelete:
+				buf.WriteString("-")
+			}
+			buf.WriteString(l.text)
+			buf.WriteString("\n")
+		}
+
+		oldLine += oldCount
+		newLine += newCount
+		i = end
+	}
+
+	return buf.String()
+}
+
+func hunkRange(start, count int) string {
+	// Unified diff line numbers are 1-based, except that an empty range
+	// refers to the line before it.
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want []DiffOp
+	}{
+		{"", "", nil},
+		{"a b c", "a b c", []DiffOp{{DiffEqual, []string{"a", "b", "c"}}}},
+		{"", "a b", []DiffOp{{DiffInsert, []string{"a", "b"}}}},
+		{"a b", "", []DiffOp{{DiffDelete, []string{"a", "b"}}}},
+		{"a b c", "a x c", []DiffOp{
+			{DiffEqual, []string{"a"}},
+			{DiffDelete, []string{"b"}},
+			{DiffInsert, []string{"x"}},
+			{DiffEqual, []string{"c"}},
+		}},
+		{"a b c", "a c", []DiffOp{
+			{DiffEqual, []string{"a"}},
+			{DiffDelete, []string{"b"}},
+			{DiffEqual, []string{"c"}},
+		}},
+		{"a c", "a b c", []DiffOp{
+			{DiffEqual, []string{"a"}},
+			{DiffInsert, []string{"b"}},
+			{DiffEqual, []string{"c"}},
+		}},
+		{"a b", "c d", []DiffOp{
+			{DiffDelete, []string{"a", "b"}},
+			{DiffInsert, []string{"c", "d"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		got := Diff(strings.Fields(tt.a), strings.Fields(tt.b))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Diff(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// Checks that the diff turns a into b and is as short as possible, by
+// comparing the number of equal tokens with the longest common subsequence.
+func TestDiffMinimal(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	alphabet := []string{"a", "b", "c", "d"}
+	random := func() []string {
+		tokens := make([]string, rng.Intn(30))
+		for i := range tokens {
+			tokens[i] = alphabet[rng.Intn(len(alphabet))]
+		}
+		return tokens
+	}
+
+	for i := 0; i < 500; i++ {
+		a, b := random(), random()
+		ops := Diff(a, b)
+
+		var oldTokens, newTokens []string
+		equal := 0
+		for _, op := range ops {
+			if op.Kind != DiffInsert {
+				oldTokens = append(oldTokens, op.Tokens...)
+			}
+			if op.Kind != DiffDelete {
+				newTokens = append(newTokens, op.Tokens...)
+			}
+			if op.Kind == DiffEqual {
+				equal += len(op.Tokens)
+			}
+		}
+		if strings.Join(oldTokens, " ") != strings.Join(a, " ") || strings.Join(newTokens, " ") != strings.Join(b, " ") {
+			t.Fatalf("Diff(%v, %v) = %v doesn't reproduce its input", a, b, ops)
+		}
+		if want := lcsLength(a, b); equal != want {
+			t.Fatalf("Diff(%v, %v) has %d equal tokens, want %d", a, b, equal, want)
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// A complete rewrite of a large page must not need memory proportional to
+// the square of its length.
+func TestDiffRewrite(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 4000; i++ {
+		a = append(a, "old line "+strings.Repeat("x", i%7))
+		b = append(b, "new line "+strings.Repeat("y", i%5))
+	}
+
+	ops := Diff(a, b)
+	want := []DiffOp{{DiffDelete, a}, {DiffInsert, b}}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("Diff of a complete rewrite returned %d ops, want a delete and an insert", len(ops))
+	}
+}
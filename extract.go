@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"code.google.com/p/go.net/html"
+	"github.com/PuerkitoBio/goquery"
+)
+
+// The ways a content check can select content from a page.  In CSS and
+// XPath modes, the check's Regex (if any) is applied to the selected text; in
+// regex mode, it's applied to the raw response body.
+const (
+	ModeCSS   = "css"
+	ModeXPath = "xpath"
+	ModeRegex = "regex"
+)
+
+// What a content check extracts from each node it selects.
+const (
+	ValueText      = "text"
+	ValueInnerHTML = "inner_html"
+	ValueOuterHTML = "outer_html"
+	ValueAttribute = "attribute"
+)
+
+// An Extraction is the content selected from a page by a check.  Values
+// holds the value taken from each matched node (or each regex match), in
+// order; Text is the values joined by newlines.
+type Extraction struct {
+	Text    string
+	HTML    string
+	Matched int
+	Values  []string
+
+	// For numeric checks, the number parsed from the content.
+	Number *float64
+
+	// For feed checks, the feed's entries.
+	Entries []*FeedEntry
+}
+
+// An ExtractError is an error that happened while extracting content, along
+// with its error class.
+type ExtractError struct {
+	Class string
+	Err   error
+}
+
+func (e *ExtractError) Error() string {
+	return e.Err.Error()
+}
+
+// Extract selects the check's content from the given response body,
+// normalises it, and parses it as a number for numeric checks.  Any error returned is an *ExtractError.
+func (c *Check) Extract(body []byte) (*Extraction, error) {
+	ext, err := c.extract(body, c.Normalize.Exclude)
+	if err != nil {
+		return ext, err
+	}
+
+	switch c.Type {
+	case CheckJSON, CheckFeed:
+	default:
+		c.Normalize.Apply(ext)
+	}
+
+	if c.Numeric.Enabled {
+		return extractNumber(ext, &c.Numeric)
+	}
+	return ext, nil
+}
+
+// Selects the check's content, removing the nodes matched by the given
+// exclusion selectors first, but without applying any other normalisation.
+func (c *Check) extract(body []byte, exclude []string) (*Extraction, error) {
+	var ext *Extraction
+	var err error
+
+	switch {
+	case c.Type == CheckJSON:
+		ext, err = extractJSON(body, c.Selector)
+	case c.Type == CheckFeed:
+		return extractFeed(body)
+	case c.Mode == ModeRegex:
+		ext = &Extraction{Text: string(body)}
+	case c.Mode == ModeXPath:
+		ext, err = extractXPath(body, c.Selector, c.Value, c.Attribute, exclude)
+	default:
+		ext, err = extractCSS(body, c.Selector, c.Value, c.Attribute, exclude)
+	}
+	if err != nil {
+		return ext, err
+	}
+
+	if len(c.Regex) > 0 {
+		return applyRegex(ext, c.Regex)
+	}
+	return ext, nil
+}
+
+func extractCSS(body []byte, selector, value, attr string, exclude []string) (*Extraction, error) {
+	root, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, &ExtractError{ErrorParse, err}
+	}
+	excludeNodes(root, exclude)
+
+	doc := goquery.NewDocumentFromNode(root)
+	ext := extractNodes(doc.Find(selector).Nodes, value, attr)
+	if ext.Matched == 0 {
+		return ext, &ExtractError{ErrorSelector, fmt.Errorf("no nodes in selection")}
+	}
+	return ext, nil
+}
+
+func extractXPath(body []byte, expr, value, attr string, exclude []string) (*Extraction, error) {
+	root, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, &ExtractError{ErrorParse, err}
+	}
+	excludeNodes(root, exclude)
+
+	xpath, err := CompileXPath(expr)
+	if err != nil {
+		return nil, &ExtractError{ErrorSelector, err}
+	}
+
+	nodes, err := xpath.Select(root)
+	if err != nil {
+		return nil, &ExtractError{ErrorSelector, err}
+	}
+
+	ext := extractNodes(nodes, value, attr)
+	if ext.Matched == 0 {
+		return ext, &ExtractError{ErrorSelector, fmt.Errorf("no nodes in selection")}
+	}
+	return ext, nil
+}
+
+// Takes the given value from each of the selected nodes.
+func extractNodes(nodes []*html.Node, value, attr string) *Extraction {
+	ext := &Extraction{
+		HTML:    renderNodes(nodes),
+		Matched: len(nodes),
+		Values:  make([]string, len(nodes)),
+	}
+	for i, n := range nodes {
+		ext.Values[i] = nodeValue(n, value, attr)
+	}
+	ext.Text = strings.Join(ext.Values, "\n")
+	return ext
+}
+
+// Returns the given value of a single node.  Nodes without the requested
+// attribute yield an empty string, so that values stay aligned with the
+// nodes they came from.
+func nodeValue(n *html.Node, value, attr string) string {
+	switch value {
+	case ValueInnerHTML:
+		if n.Type == attributeNode {
+			return html.EscapeString(n.Attr[0].Val)
+		}
+		var buf bytes.Buffer
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			html.Render(&buf, c)
+		}
+		return buf.String()
+
+	case ValueOuterHTML:
+		return renderNodes([]*html.Node{n})
+
+	case ValueAttribute:
+		attr = strings.ToLower(attr)
+		for _, a := range n.Attr {
+			if a.Key == attr {
+				return a.Val
+			}
+		}
+		return ""
+	}
+
+	return xpathStringValue(n)
+}
+
+// Extracts the values matching a JSON path.  The result is re-encoded as
+// indented JSON, which sorts object keys, so that the hash doesn't depend on
+// the order of keys in the response.  A path matching more than one value
+// yields an array of the values.
+func extractJSON(body []byte, path string) (*Extraction, error) {
+	doc, err := decodeJSON(body)
+	if err != nil {
+		return nil, &ExtractError{ErrorParse, err}
+	}
+
+	jp, err := CompileJSONPath(path)
+	if err != nil {
+		return nil, &ExtractError{ErrorSelector, err}
+	}
+
+	values := jp.Select(doc)
+	if len(values) == 0 {
+		return &Extraction{}, &ExtractError{ErrorSelector, fmt.Errorf("path matched nothing")}
+	}
+
+	var result interface{} = values
+	if len(values) == 1 {
+		result = values[0]
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return nil, &ExtractError{ErrorParse, err}
+	}
+
+	return &Extraction{
+		Text:    string(data),
+		Matched: len(values),
+	}, nil
+}
+
+// Applies the regular expression to the extracted text.  If the expression
+// has capture groups, the groups from each match are kept; otherwise, the
+// whole match is.  Matches are separated by newlines.
+func applyRegex(ext *Extraction, pattern string) (*Extraction, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return ext, &ExtractError{ErrorSelector, err}
+	}
+
+	var parts []string
+	matches := re.FindAllStringSubmatch(ext.Text, -1)
+	for _, m := range matches {
+		if len(m) == 1 {
+			parts = append(parts, m[0])
+		} else {
+			parts = append(parts, m[1:]...)
+		}
+	}
+
+	ret := &Extraction{
+		Text:    strings.Join(parts, "\n"),
+		Matched: len(matches),
+		Values:  parts,
+	}
+	if ret.Matched == 0 {
+		return ret, &ExtractError{ErrorSelector, fmt.Errorf("regex did not match")}
+	}
+	return ret, nil
+}
+
+// Renders the outer HTML of every node.  Attribute nodes selected by XPath
+// are rendered as name="value".
+func renderNodes(nodes []*html.Node) string {
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		if node.Type == attributeNode {
+			fmt.Fprintf(&buf, "%s=\"%s\"", node.Attr[0].Key, html.EscapeString(node.Attr[0].Val))
+			continue
+		}
+		html.Render(&buf, node)
+	}
+	return buf.String()
+}
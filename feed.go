@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// The notification event sent for each new entry in a feed check.
+const EventNewEntry = "new_entry"
+
+// A FeedEntry is a single item from an RSS or Atom feed.  ID is the entry's
+// GUID (RSS) or id (Atom), falling back to its link, its title, or failing
+// those a hash of its content.
+type FeedEntry struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Link      string    `json:"link"`
+	Published time.Time `json:"published"`
+}
+
+// Renders the entry as a few lines of text, as stored in snapshots.
+func (e *FeedEntry) String() string {
+	s := e.Title + "\n" + e.Link
+	if !e.Published.IsZero() {
+		s += "\n" + e.Published.Format(time.RFC3339)
+	}
+	return s
+}
+
+// The parts of RSS 2.0, RSS 1.0 (RDF) and Atom documents that we care about.
+// Which fields are filled in depends on the root element.
+type feedDocument struct {
+	XMLName xml.Name
+	Channel struct {
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Items   []rssItem   `xml:"item"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title   string `xml:"title"`
+	Link    string `xml:"link"`
+	GUID    string `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+	Date    string `xml:"http://purl.org/dc/elements/1.1/ date"`
+}
+
+type atomEntry struct {
+	ID        string `xml:"id"`
+	Title     string `xml:"title"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+	Links     []struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"link"`
+}
+
+// ParseFeed parses an RSS or Atom feed, returning its entries in document
+// order.
+func ParseFeed(data []byte) ([]*FeedEntry, error) {
+	var doc feedDocument
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+
+	// Bodies have already been transcoded to UTF-8 by DecodeBody, whatever
+	// the XML declaration says.
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var entries []*FeedEntry
+	switch doc.XMLName.Local {
+	case "rss", "RDF":
+		items := doc.Channel.Items
+		if doc.XMLName.Local == "RDF" {
+			items = doc.Items
+		}
+		for _, item := range items {
+			e := &FeedEntry{
+				ID:    strings.TrimSpace(item.GUID),
+				Title: strings.TrimSpace(item.Title),
+				Link:  strings.TrimSpace(item.Link),
+			}
+			if len(item.PubDate) > 0 {
+				e.Published = parseFeedTime(item.PubDate)
+			} else {
+				e.Published = parseFeedTime(item.Date)
+			}
+			entries = append(entries, e)
+		}
+
+	case "feed":
+		for _, entry := range doc.Entries {
+			e := &FeedEntry{
+				ID:    strings.TrimSpace(entry.ID),
+				Title: strings.TrimSpace(entry.Title),
+			}
+			for _, link := range entry.Links {
+				if link.Rel == "" || link.Rel == "alternate" {
+					e.Link = strings.TrimSpace(link.Href)
+					break
+				}
+			}
+			if len(entry.Published) > 0 {
+				e.Published = parseFeedTime(entry.Published)
+			} else {
+				e.Published = parseFeedTime(entry.Updated)
+			}
+			entries = append(entries, e)
+		}
+
+	default:
+		return nil, fmt.Errorf("not an RSS or Atom feed (root element is <%s>)", doc.XMLName.Local)
+	}
+
+	for _, e := range entries {
+		if len(e.ID) == 0 {
+			e.ID = e.Link
+		}
+		if len(e.ID) == 0 {
+			e.ID = e.Title
+		}
+		if len(e.ID) == 0 {
+			e.ID = HashText(e.String())
+		}
+	}
+	return entries, nil
+}
+
+// The date formats seen in the wild in feeds.  RSS is supposed to use RFC 822
+// and Atom RFC 3339, but plenty of feeds don't.
+var feedTimeFormats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"Mon, 02 Jan 2006 15:04 -0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// Parses a feed date, returning the zero time if it isn't in any known
+// format.
+func parseFeedTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, format := range feedTimeFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func extractFeed(body []byte) (*Extraction, error) {
+	entries, err := ParseFeed(body)
+	if err != nil {
+		return nil, &ExtractError{ErrorParse, err}
+	}
+
+	texts := make([]string, len(entries))
+	for i, e := range entries {
+		texts[i] = e.String()
+	}
+
+	return &Extraction{
+		Text:    strings.Join(texts, "\n\n"),
+		Matched: len(entries),
+		Entries: entries,
+	}, nil
+}
+
+// Records the given entries as seen for the check, returning those that
+// weren't seen before.  The first time a check's entries are recorded, all of
+// them are considered already seen, so that creating a feed check doesn't
+// report every entry currently in the feed as new.  Entries that have left
+// the feed are forgotten, so an entry that drops out and comes back is
+// reported again.
+func markFeedEntriesSeen(tx *bolt.Tx, id uint64, entries []*FeedEntry) ([]*FeedEntry, error) {
+	parent := tx.Bucket(FeedEntriesBucket)
+	first := parent.Bucket(KeyFor(id)) == nil
+
+	b, err := parent.CreateBucketIfNotExists(KeyFor(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var fresh []*FeedEntry
+	current := make(map[string]bool)
+	for _, e := range entries {
+		current[e.ID] = true
+		if b.Get([]byte(e.ID)) != nil {
+			continue
+		}
+
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		if err = b.Put([]byte(e.ID), data); err != nil {
+			return nil, err
+		}
+
+		if !first {
+			fresh = append(fresh, e)
+		}
+	}
+
+	// A feed with no entries is more likely to be broken than empty, so
+	// keep what was seen before.
+	if len(entries) == 0 {
+		return fresh, nil
+	}
+
+	// Collect keys first, since we can't modify the bucket while iterating.
+	var gone [][]byte
+	b.ForEach(func(k, v []byte) error {
+		if !current[string(k)] {
+			gone = append(gone, k)
+		}
+		return nil
+	})
+	for _, k := range gone {
+		if err := b.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return fresh, nil
+}
+
+// Saves the given snapshot of a feed check, along with a change record for
+// each entry that hasn't been seen before.  Nothing is saved if there are no
+// new entries, unless this is the check's first run.  Feeds conventionally
+// list their newest entries first, so changes are recorded in reverse
+// document order.  The entries are marked as seen in the same transaction
+// that saves the snapshot and changes, so that if that fails they're reported
+// on the next run instead; errors are logged, and nothing is recorded.
+func (c *Check) recordFeedEntries(db *bolt.DB, snap *Snapshot, entries []*FeedEntry) []*Change {
+	prev, err := GetLatestSnapshot(db, c.ID, "")
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error loading previous snapshot")
+	}
+
+	var changes []*Change
+	err = db.Update(func(tx *bolt.Tx) error {
+		fresh, err := markFeedEntriesSeen(tx, c.ID, entries)
+		if err != nil {
+			return err
+		}
+
+		// Edits to entries that were already seen aren't recorded,
+		// except as the check's first snapshot.
+		if len(fresh) == 0 && len(c.LastHash) > 0 {
+			return nil
+		}
+
+		if err := saveSnapshot(tx, snap); err != nil {
+			return err
+		}
+
+		for i := len(fresh) - 1; i >= 0; i-- {
+			change := &Change{
+				CheckID:       c.ID,
+				Time:          snap.Time,
+				NewSnapshotID: snap.ID,
+				OldHash:       c.LastHash,
+				NewHash:       snap.Hash,
+				Entry:         fresh[i],
+			}
+			if prev != nil {
+				change.OldSnapshotID = prev.ID
+			}
+
+			if err := saveChange(tx, change); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error recording feed entries")
+		return nil
+	}
+
+	if len(changes) > 0 {
+		c.LastChangeID = changes[len(changes)-1].ID
+	}
+	return changes
+}
+
+// Sends a new entry notification to each of this check's notifiers.
+func (c *Check) notifyEntry(db *bolt.DB, change *Change) {
+	c.notify(db, &Notification{
+		Event:    EventNewEntry,
+		CheckID:  c.ID,
+		URL:      c.URL,
+		Selector: c.Selector,
+		Time:     change.Time,
+		ChangeID: change.ID,
+		OldHash:  change.OldHash,
+		NewHash:  change.NewHash,
+		Entry:    change.Entry,
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The timeout and User-Agent used for fetches that don't specify their own.
+// An empty User-Agent means Go's default.
+var (
+	DefaultFetchTimeout = 30 * time.Second
+	DefaultUserAgent    = ""
+)
+
+// The maximum number of redirects followed when a check doesn't specify one.
+const defaultMaxRedirects = 10
+
+// FetchOptions controls how a check's URL is requested.  The zero value
+// performs a plain GET with the default timeout, following redirects.
+type FetchOptions struct {
+	Method    string            `json:"method,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Cookies   map[string]string `json:"cookies,omitempty"`
+
+	// Authentication.  At most one of basic or bearer auth may be set.
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	BearerToken string `json:"bearer_token,omitempty"`
+
+	// A duration string, such as "10s".
+	Timeout string `json:"timeout,omitempty"`
+
+	// Whether to follow redirects, and how many.  MaxRedirects of zero means
+	// the default.
+	NoRedirects  bool `json:"no_redirects,omitempty"`
+	MaxRedirects int  `json:"max_redirects,omitempty"`
+
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+	Proxy              string `json:"proxy,omitempty"`
+}
+
+var allowedFetchMethods = map[string]bool{
+	"GET":  true,
+	"POST": true,
+	"HEAD": true,
+}
+
+func (o *FetchOptions) Validate() *ValidationError {
+	if len(o.Method) > 0 && !allowedFetchMethods[strings.ToUpper(o.Method)] {
+		return &ValidationError{"fetch.method", "method must be one of GET, POST or HEAD"}
+	}
+	if len(o.BearerToken) > 0 && len(o.Username) > 0 {
+		return &ValidationError{"fetch.bearer_token", "cannot use both basic and bearer authentication"}
+	}
+	if len(o.Timeout) > 0 {
+		d, err := time.ParseDuration(o.Timeout)
+		if err != nil {
+			return &ValidationError{"fetch.timeout", err.Error()}
+		}
+		if d <= 0 {
+			return &ValidationError{"fetch.timeout", "timeout must be positive"}
+		}
+	}
+	if o.MaxRedirects < 0 {
+		return &ValidationError{"fetch.max_redirects", "max_redirects cannot be negative"}
+	}
+	if len(o.Proxy) > 0 {
+		if _, err := url.Parse(o.Proxy); err != nil {
+			return &ValidationError{"fetch.proxy", err.Error()}
+		}
+	}
+	return nil
+}
+
+// Returns the configured timeout, or the default if none is set.
+func (o *FetchOptions) timeout() time.Duration {
+	if d, err := time.ParseDuration(o.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DefaultFetchTimeout
+}
+
+// Fetch requests the given URL according to the options.  The caller is
+// responsible for closing the response body.
+func Fetch(u string, o *FetchOptions) (*http.Response, error) {
+	method := "GET"
+	if len(o.Method) > 0 {
+		method = strings.ToUpper(o.Method)
+	}
+
+	var body io.Reader
+	if len(o.Body) > 0 {
+		body = strings.NewReader(o.Body)
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range o.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(o.UserAgent) > 0 {
+		req.Header.Set("User-Agent", o.UserAgent)
+	} else if len(DefaultUserAgent) > 0 && len(req.Header.Get("User-Agent")) == 0 {
+		req.Header.Set("User-Agent", DefaultUserAgent)
+	}
+	for name, value := range o.Cookies {
+		req.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	if len(o.Username) > 0 {
+		req.SetBasicAuth(o.Username, o.Password)
+	}
+	if len(o.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+o.BearerToken)
+	}
+
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DisableKeepAlives: true,
+	}
+	if o.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if len(o.Proxy) > 0 {
+		proxy, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	maxRedirects := defaultMaxRedirects
+	if o.MaxRedirects > 0 {
+		maxRedirects = o.MaxRedirects
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   o.timeout(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if o.NoRedirects {
+				return http.ErrUseLastResponse
+			}
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+
+	return client.Do(req)
+}
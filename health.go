@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// The health states a check can be in.  A check is degraded when its most
+// recent runs have failed, but not yet enough of them in a row to reach its
+// failure threshold.
+const (
+	HealthUnknown  = ""
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+	HealthFailing  = "failing"
+)
+
+// The number of consecutive failures before a check is considered failing,
+// for checks that don't specify their own threshold.
+const defaultFailureThreshold = 3
+
+// Notification events for health transitions.
+const (
+	EventFailing   = "failing"
+	EventRecovered = "recovered"
+)
+
+func (c *Check) failureThreshold() int {
+	if c.FailureThreshold > 0 {
+		return c.FailureThreshold
+	}
+	return defaultFailureThreshold
+}
+
+// Updates the check's health from the outcome of a run, sending a
+// notification if the check has just started failing or has recovered.
+func (c *Check) recordHealth(db *bolt.DB, run *Run) {
+	prev := c.Health
+
+	if run.Succeeded() {
+		c.ConsecutiveFailures = 0
+		c.LastError = ""
+		c.Health = HealthOK
+	} else {
+		c.ConsecutiveFailures++
+		c.LastError = run.Error
+		if c.ConsecutiveFailures >= c.failureThreshold() {
+			c.Health = HealthFailing
+		} else {
+			c.Health = HealthDegraded
+		}
+	}
+
+	if prev == c.Health {
+		return
+	}
+
+	log.WithFields(logrus.Fields{
+		"id":       c.ID,
+		"previous": prev,
+		"health":   c.Health,
+		"failures": c.ConsecutiveFailures,
+	}).Info("check health changed")
+
+	var event string
+	switch {
+	case c.Health == HealthFailing:
+		event = EventFailing
+	case c.Health == HealthOK && prev == HealthFailing:
+		event = EventRecovered
+	default:
+		return
+	}
+
+	c.notify(db, &Notification{
+		Event:    event,
+		CheckID:  c.ID,
+		URL:      c.URL,
+		Selector: c.Selector,
+		Time:     time.Now(),
+		Error:    c.LastError,
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRecordHealth(t *testing.T) {
+	tests := []struct {
+		threshold int
+		failures  int
+		want      string
+	}{
+		{0, 0, HealthOK},
+		{0, 1, HealthDegraded},
+		{0, 2, HealthDegraded},
+		{0, 3, HealthFailing},
+		{0, 4, HealthFailing},
+		{1, 1, HealthFailing},
+		{1, 2, HealthFailing},
+		{5, 4, HealthDegraded},
+		{5, 5, HealthFailing},
+	}
+
+	for _, tt := range tests {
+		c := &Check{FailureThreshold: tt.threshold}
+		c.recordHealth(nil, &Run{})
+		for i := 0; i < tt.failures; i++ {
+			c.recordHealth(nil, &Run{ErrorClass: ErrorConnection, Error: "refused"})
+		}
+		if c.Health != tt.want || c.ConsecutiveFailures != tt.failures {
+			t.Errorf("threshold %d after %d failures: health %q, %d failures, want %q",
+				tt.threshold, tt.failures, c.Health, c.ConsecutiveFailures, tt.want)
+		}
+
+		// A successful run always recovers the check.
+		c.recordHealth(nil, &Run{})
+		if c.Health != HealthOK || c.ConsecutiveFailures != 0 || c.LastError != "" {
+			t.Errorf("threshold %d: health %q, %d failures after a successful run, want ok",
+				tt.threshold, c.Health, c.ConsecutiveFailures)
+		}
+	}
+}
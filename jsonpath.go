@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A JSONPath is a compiled path expression for selecting values from a
+// decoded JSON document.  The supported syntax is a subset of JSONPath:
+//
+//	$               the root (optional at the start of the path)
+//	.key, ['key']   an object member
+//	[n]             an array element; negative indices count from the end
+//	.*, [*]         every member or element
+//	..key, ..*      recursive descent
+type JSONPath struct {
+	steps []jsonPathStep
+}
+
+type jsonPathStep struct {
+	recursive bool
+	wildcard  bool
+	key       string
+	index     int
+	isIndex   bool
+}
+
+// CompileJSONPath parses the given path expression.  An empty expression
+// selects the whole document.
+func CompileJSONPath(s string) (*JSONPath, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "$")
+
+	p := &JSONPath{}
+	for i := 0; i < len(s); {
+		step := jsonPathStep{}
+
+		switch {
+		case strings.HasPrefix(s[i:], ".."):
+			step.recursive = true
+			i += 2
+		case s[i] == '.':
+			i++
+		case s[i] == '[':
+		default:
+			if i != 0 {
+				return nil, fmt.Errorf("unexpected '%c' at position %d", s[i], i)
+			}
+			// Allow a leading bare key, as in "data.items".
+		}
+
+		if i < len(s) && s[i] == '[' {
+			end := strings.IndexByte(s[i:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated '[' at position %d", i)
+			}
+			inner := strings.TrimSpace(s[i+1 : i+end])
+			i += end + 1
+
+			switch {
+			case inner == "*":
+				step.wildcard = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				step.key = inner[1 : len(inner)-1]
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid subscript '%s'", inner)
+				}
+				step.index = n
+				step.isIndex = true
+			}
+		} else {
+			end := i
+			for end < len(s) && s[end] != '.' && s[end] != '[' {
+				end++
+			}
+			name := s[i:end]
+			if len(name) == 0 {
+				return nil, fmt.Errorf("missing key at position %d", i)
+			}
+			i = end
+
+			if name == "*" {
+				step.wildcard = true
+			} else {
+				step.key = name
+			}
+		}
+
+		p.steps = append(p.steps, step)
+	}
+
+	return p, nil
+}
+
+// Select returns every value matched by the path.
+func (p *JSONPath) Select(doc interface{}) []interface{} {
+	values := []interface{}{doc}
+	for _, step := range p.steps {
+		var next []interface{}
+		for _, v := range values {
+			if step.recursive {
+				for _, d := range jsonDescendants(v) {
+					next = append(next, step.apply(d)...)
+				}
+			} else {
+				next = append(next, step.apply(v)...)
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func (s *jsonPathStep) apply(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if s.wildcard {
+			var ret []interface{}
+			for _, k := range sortedKeys(v) {
+				ret = append(ret, v[k])
+			}
+			return ret
+		}
+		if child, ok := v[s.key]; ok && !s.isIndex {
+			return []interface{}{child}
+		}
+
+	case []interface{}:
+		if s.wildcard {
+			return v
+		}
+		if s.isIndex {
+			i := s.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				return []interface{}{v[i]}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the value and all values nested within it, parents first.
+func jsonDescendants(v interface{}) []interface{} {
+	ret := []interface{}{v}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			ret = append(ret, jsonDescendants(v[k])...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			ret = append(ret, jsonDescendants(child)...)
+		}
+	}
+	return ret
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A KeyChange describes a change to a single leaf value of a JSON document,
+// identified by its path.
+type KeyChange struct {
+	Path string          `json:"path"`
+	Kind string          `json:"kind"`
+	Old  json.RawMessage `json:"old,omitempty"`
+	New  json.RawMessage `json:"new,omitempty"`
+}
+
+// DiffJSON compares two decoded JSON documents leaf by leaf, returning the
+// changes sorted by path.  Either document may be nil.
+func DiffJSON(old, new interface{}) []KeyChange {
+	oldLeaves := make(map[string]json.RawMessage)
+	newLeaves := make(map[string]json.RawMessage)
+	if old != nil {
+		flattenJSON("$", old, oldLeaves)
+	}
+	if new != nil {
+		flattenJSON("$", new, newLeaves)
+	}
+
+	var changes []KeyChange
+	for path, o := range oldLeaves {
+		n, ok := newLeaves[path]
+		switch {
+		case !ok:
+			changes = append(changes, KeyChange{path, ValueRemoved, o, nil})
+		case !bytes.Equal(o, n):
+			changes = append(changes, KeyChange{path, ValueModified, o, n})
+		}
+	}
+	for path, n := range newLeaves {
+		if _, ok := oldLeaves[path]; !ok {
+			changes = append(changes, KeyChange{path, ValueAdded, nil, n})
+		}
+	}
+
+	sort.Sort(keyChangesByPath(changes))
+	return changes
+}
+
+// Records the canonical JSON of every leaf value under the given path.
+// Empty objects and arrays count as leaves.
+func flattenJSON(path string, v interface{}, out map[string]json.RawMessage) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) > 0 {
+			for k, child := range v {
+				flattenJSON(path+jsonPathKey(k), child, out)
+			}
+			return
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			for i, child := range v {
+				flattenJSON(fmt.Sprintf("%s[%d]", path, i), child, out)
+			}
+			return
+		}
+	}
+
+	data, _ := json.Marshal(v)
+	out[path] = data
+}
+
+// Formats an object key as a path component, quoting it if necessary.
+func jsonPathKey(k string) string {
+	if len(k) > 0 && !strings.ContainsAny(k, ".[]'\" ") {
+		return "." + k
+	}
+	return "['" + k + "']"
+}
+
+type keyChangesByPath []KeyChange
+
+func (s keyChangesByPath) Len() int           { return len(s) }
+func (s keyChangesByPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s keyChangesByPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+
+// Decodes JSON, keeping numbers as json.Number so that they round-trip
+// exactly.
+func decodeJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
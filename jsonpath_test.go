@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const jsonPathTestDoc = `{
+	"name": "shop",
+	"items": [
+		{"id": 1, "price": 9.99, "tags": ["a", "b"]},
+		{"id": 2, "price": 100000000000000000001, "tags": []}
+	],
+	"meta": {"count": 2, "odd.key": true, "nested": {"id": 3}},
+	"empty": null
+}`
+
+func TestJSONPathSelect(t *testing.T) {
+	doc, err := decodeJSON([]byte(jsonPathTestDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", `[` + compactJSON(t, jsonPathTestDoc) + `]`},
+		{"$", `[` + compactJSON(t, jsonPathTestDoc) + `]`},
+		{"$.name", `["shop"]`},
+		{"name", `["shop"]`},
+		{"$['name']", `["shop"]`},
+		{`$["name"]`, `["shop"]`},
+		{"$.items[0].id", `[1]`},
+		{"$.items[-1].id", `[2]`},
+		{"$.items[2]", `null`},
+		{"$.items[-3]", `null`},
+		{"$.items[*].id", `[1,2]`},
+		{"$.items.*.price", `[9.99,100000000000000000001]`},
+		{"$.items[0].tags[*]", `["a","b"]`},
+		{"$.items[1].tags[*]", `null`},
+		{"$.meta['odd.key']", `[true]`},
+		{"$.meta.*", `[2,{"id":3},true]`},
+		{"$..id", `[1,2,3]`},
+		{"$..tags[0]", `["a"]`},
+		{"$.empty", `[null]`},
+		{"$.missing", `null`},
+		{"$.name.length", `null`},
+		{"$.items.id", `null`},
+		{"$.meta[0]", `null`},
+	}
+
+	for _, tt := range tests {
+		p, err := CompileJSONPath(tt.path)
+		if err != nil {
+			t.Errorf("CompileJSONPath(%q) returned error: %v", tt.path, err)
+			continue
+		}
+		data, err := json.Marshal(p.Select(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("Select(%q) = %s, want %s", tt.path, data, tt.want)
+		}
+	}
+}
+
+func TestJSONPathInvalid(t *testing.T) {
+	for _, path := range []string{
+		"$.items[0",
+		"$.items[x]",
+		"$.items[]",
+		"$.",
+		"$..",
+		"$.items.",
+		"$.items[0]id",
+	} {
+		if _, err := CompileJSONPath(path); err == nil {
+			t.Errorf("CompileJSONPath(%q) succeeded, want an error", path)
+		}
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	tests := []struct {
+		old, new string
+		want     []KeyChange
+	}{
+		{`{"a": 1}`, `{"a": 1}`, nil},
+		{`{"a": 1}`, `{"a": 2}`, []KeyChange{{"$.a", ValueModified, json.RawMessage(`1`), json.RawMessage(`2`)}}},
+		{`{"a": 1}`, `{"a": 1.0}`, []KeyChange{{"$.a", ValueModified, json.RawMessage(`1`), json.RawMessage(`1.0`)}}},
+		{`{"a": 1}`, `{"b": 1}`, []KeyChange{
+			{"$.a", ValueRemoved, json.RawMessage(`1`), nil},
+			{"$.b", ValueAdded, nil, json.RawMessage(`1`)},
+		}},
+		{`[1, 2]`, `[1]`, []KeyChange{{"$[1]", ValueRemoved, json.RawMessage(`2`), nil}}},
+		{`{"a": {}}`, `{"a": {"b": null}}`, []KeyChange{
+			{"$.a", ValueRemoved, json.RawMessage(`{}`), nil},
+			{"$.a.b", ValueAdded, nil, json.RawMessage(`null`)},
+		}},
+		{`{"a b": "x"}`, `{"a b": "y"}`, []KeyChange{{"$['a b']", ValueModified, json.RawMessage(`"x"`), json.RawMessage(`"y"`)}}},
+		{``, `{"a": [true]}`, []KeyChange{{"$.a[0]", ValueAdded, nil, json.RawMessage(`true`)}}},
+	}
+
+	for _, tt := range tests {
+		var old, new interface{}
+		if len(tt.old) > 0 {
+			old = mustDecodeJSON(t, tt.old)
+		}
+		if len(tt.new) > 0 {
+			new = mustDecodeJSON(t, tt.new)
+		}
+
+		got := DiffJSON(old, new)
+		gotData, _ := json.Marshal(got)
+		wantData, _ := json.Marshal(tt.want)
+		if string(gotData) != string(wantData) {
+			t.Errorf("DiffJSON(%s, %s) = %s, want %s", tt.old, tt.new, gotData, wantData)
+		}
+	}
+}
+
+func mustDecodeJSON(t *testing.T, s string) interface{} {
+	v, err := decodeJSON([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func compactJSON(t *testing.T, s string) string {
+	data, err := json.Marshal(mustDecodeJSON(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
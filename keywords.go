@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The kinds of keyword condition.
+const (
+	KeywordContains    = "contains"
+	KeywordNotContains = "not_contains"
+	KeywordMatches     = "matches"
+)
+
+// A KeywordCondition tests the extracted content for a phrase or regular
+// expression.  Checks with keyword conditions only report a change when one
+// of the conditions changes from met to unmet or back; other edits to the
+// content are ignored.  Met is nil until the condition has first been
+// evaluated.
+type KeywordCondition struct {
+	Kind       string `json:"kind"`
+	Text       string `json:"text"`
+	IgnoreCase bool   `json:"ignore_case,omitempty"`
+	Met        *bool  `json:"met,omitempty"`
+}
+
+func (k *KeywordCondition) Validate() error {
+	switch k.Kind {
+	case KeywordContains, KeywordNotContains:
+		if len(k.Text) == 0 {
+			return fmt.Errorf("missing Text parameter")
+		}
+	case KeywordMatches:
+		if _, err := k.regexp(); err != nil {
+			return fmt.Errorf("invalid regular expression: %s", err)
+		}
+	default:
+		return fmt.Errorf("kind must be one of 'contains', 'not_contains' or 'matches'")
+	}
+	return nil
+}
+
+func (k *KeywordCondition) regexp() (*regexp.Regexp, error) {
+	if k.IgnoreCase {
+		return regexp.Compile("(?i)" + k.Text)
+	}
+	return regexp.Compile(k.Text)
+}
+
+// Reports whether the condition is met by the given text.
+func (k *KeywordCondition) Test(text string) bool {
+	switch k.Kind {
+	case KeywordMatches:
+		re, err := k.regexp()
+		return err == nil && re.MatchString(text)
+	}
+
+	needle := k.Text
+	if k.IgnoreCase {
+		text = strings.ToLower(text)
+		needle = strings.ToLower(needle)
+	}
+	contains := strings.Contains(text, needle)
+	if k.Kind == KeywordNotContains {
+		return !contains
+	}
+	return contains
+}
+
+// Describes the content after the condition changed to the given state.
+func (k *KeywordCondition) describe(met bool) string {
+	if k.Kind == KeywordMatches {
+		if met {
+			return fmt.Sprintf("now matches /%s/", k.Text)
+		}
+		return fmt.Sprintf("no longer matches /%s/", k.Text)
+	}
+
+	// A not_contains condition is met when the text is absent.
+	present := met == (k.Kind == KeywordContains)
+	if present {
+		return fmt.Sprintf("now contains %q", k.Text)
+	}
+	return fmt.Sprintf("no longer contains %q", k.Text)
+}
+
+// Evaluates each condition against the text, updating its state, and returns
+// a description of each condition whose state changed.  Conditions that
+// haven't been evaluated before don't count as changed.
+func evaluateKeywords(keywords []KeywordCondition, text string) []string {
+	var changed []string
+	for i := range keywords {
+		k := &keywords[i]
+		met := k.Test(text)
+		if k.Met != nil && *k.Met != met {
+			changed = append(changed, k.describe(met))
+		}
+		k.Met = &met
+	}
+	return changed
+}
+
+// Returns the keyword conditions that apply to the given field of the check.
+func (c *Check) keywordsFor(field string) []KeywordCondition {
+	if rule := c.rule(field); rule != nil {
+		return rule.Keywords
+	}
+	return c.Keywords
+}
+
+// Copies the state of any of the old conditions into the same conditions in
+// the check's new list, so that editing a check's conditions doesn't reset
+// the state of the ones that were kept.
+func keepKeywordStates(keywords, old []KeywordCondition) {
+	for i := range keywords {
+		for _, o := range old {
+			if o.Kind == keywords[i].Kind && o.Text == keywords[i].Text && o.IgnoreCase == keywords[i].IgnoreCase {
+				keywords[i].Met = o.Met
+			}
+		}
+	}
+}
+
+func validateKeywords(keywords []KeywordCondition) *ValidationError {
+	for i := range keywords {
+		if err := keywords[i].Validate(); err != nil {
+			return &ValidationError{fmt.Sprintf("keywords[%d]", i), err.Error()}
+		}
+	}
+	return nil
+}
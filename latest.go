@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/boltdb/bolt"
+)
+
+// The latest bucket indexes the most recent record of each kind for each
+// check, so that it can be found without loading the check's whole history.
+// Record keys are little-endian, so bolt's ordering can't be used for this.
+// Each check has a nested bucket mapping the name of the record's bucket,
+// followed by its field, if any, to the record's ID.  Some kinds of record
+// also have their number kept, under the bucket's name followed by "#".
+func latestKey(bucket []byte, field string) []byte {
+	return []byte(string(bucket) + "/" + field)
+}
+
+// Records that the given ID is the most recent record in the bucket for the
+// given check and field.
+func setLatest(tx *bolt.Tx, checkID uint64, bucket []byte, field string, id uint64) error {
+	b, err := tx.Bucket(LatestBucket).CreateBucketIfNotExists(KeyFor(checkID))
+	if err != nil {
+		return err
+	}
+	return b.Put(latestKey(bucket, field), KeyFor(id))
+}
+
+// Returns the ID of the most recent record in the bucket for the given check
+// and field, or false if it isn't indexed.  Databases written before the
+// index existed have no entries until the next record is saved, so callers
+// should fall back to scanning.
+func getLatest(tx *bolt.Tx, checkID uint64, bucket []byte, field string) (uint64, bool) {
+	b := tx.Bucket(LatestBucket).Bucket(KeyFor(checkID))
+	if b == nil {
+		return 0, false
+	}
+
+	data := b.Get(latestKey(bucket, field))
+	if len(data) != 8 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(data), true
+}
+
+func countKey(bucket []byte) []byte {
+	return []byte(string(bucket) + "#")
+}
+
+// Adds delta to the number of records in the bucket for the given check.  If
+// the number isn't known yet, it's set to initial instead.
+func addCount(tx *bolt.Tx, checkID uint64, bucket []byte, delta int, initial func() int) error {
+	b, err := tx.Bucket(LatestBucket).CreateBucketIfNotExists(KeyFor(checkID))
+	if err != nil {
+		return err
+	}
+
+	var n int
+	if data := b.Get(countKey(bucket)); len(data) == 8 {
+		n = int(binary.LittleEndian.Uint64(data)) + delta
+	} else if initial != nil {
+		n = initial()
+	} else {
+		return nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	return b.Put(countKey(bucket), KeyFor(n))
+}
+
+// Returns the number of records in the bucket for the given check, or false
+// if it isn't known.
+func getCount(tx *bolt.Tx, checkID uint64, bucket []byte) (int, bool) {
+	b := tx.Bucket(LatestBucket).Bucket(KeyFor(checkID))
+	if b == nil {
+		return 0, false
+	}
+
+	data := b.Get(countKey(bucket))
+	if len(data) != 8 {
+		return 0, false
+	}
+	return int(binary.LittleEndian.Uint64(data)), true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Blocks of changed lines larger than this many characters aren't diffed
+// character by character; every character in them counts as changed.
+const maxCharDiff = 500
+
+// A Magnitude measures how much content changed.  LinesPercent is the number
+// of lines inserted or deleted as a percentage of the lines in the old and
+// new content together, so a complete rewrite is 100%.
+type Magnitude struct {
+	LinesChanged int     `json:"lines_changed"`
+	LinesPercent float64 `json:"lines_percent"`
+	CharsChanged int     `json:"chars_changed"`
+}
+
+// Measures a line-level diff.  Characters are counted by diffing each block
+// of deleted and inserted lines character by character, so that a one
+// character edit to a long line counts as two changed characters (one
+// deleted and one inserted), not the whole line.
+func MeasureChange(ops []DiffOp) Magnitude {
+	var m Magnitude
+	var total int
+	var deleted, inserted []string
+
+	flush := func() {
+		if len(deleted) > 0 || len(inserted) > 0 {
+			m.CharsChanged += countCharsChanged(strings.Join(deleted, "\n"), strings.Join(inserted, "\n"))
+		}
+		deleted, inserted = nil, nil
+	}
+
+	for _, op := range ops {
+		switch op.Kind {
+		case DiffEqual:
+			flush()
+			total += 2 * len(op.Tokens)
+		case DiffDelete:
+			deleted = append(deleted, op.Tokens...)
+			m.LinesChanged += len(op.Tokens)
+			total += len(op.Tokens)
+		case DiffInsert:
+			inserted = append(inserted, op.Tokens...)
+			m.LinesChanged += len(op.Tokens)
+			total += len(op.Tokens)
+		}
+	}
+	flush()
+
+	if total > 0 {
+		m.LinesPercent = float64(m.LinesChanged) / float64(total) * 100
+	}
+	return m
+}
+
+// Counts the characters deleted from old and inserted into new.
+func countCharsChanged(old, new string) int {
+	if utf8.RuneCountInString(old)+utf8.RuneCountInString(new) > maxCharDiff {
+		return utf8.RuneCountInString(old) + utf8.RuneCountInString(new)
+	}
+
+	var n int
+	for _, op := range Diff(strings.Split(old, ""), strings.Split(new, "")) {
+		if op.Kind != DiffEqual {
+			n += len(op.Tokens)
+		}
+	}
+	return n
+}
+
+// ChangeThreshold is the smallest change a check reports.  Smaller changes
+// are ignored, but still count towards the next change, since changes are
+// always measured against the last reported content.  Zero disables either
+// limit.
+type ChangeThreshold struct {
+	LinesPercent float64 `json:"lines_percent,omitempty"`
+	Chars        int     `json:"chars,omitempty"`
+}
+
+func (t *ChangeThreshold) Validate() *ValidationError {
+	if t.LinesPercent < 0 || t.LinesPercent > 100 {
+		return &ValidationError{"min_change.lines_percent", "lines_percent must be between 0 and 100"}
+	}
+	if t.Chars < 0 {
+		return &ValidationError{"min_change.chars", "chars must not be negative"}
+	}
+	return nil
+}
+
+// Returns true if either limit is set.
+func (t *ChangeThreshold) Enabled() bool {
+	return t.LinesPercent > 0 || t.Chars > 0
+}
+
+// Returns true if a change of the given magnitude is too small to report.
+func (t *ChangeThreshold) Ignores(m Magnitude) bool {
+	return m.LinesPercent < t.LinesPercent || m.CharsChanged < t.Chars
+}
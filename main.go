@@ -3,12 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
-	"github.com/robfig/cron"
 	"github.com/zenazn/goji/bind"
 	"github.com/zenazn/goji/graceful"
 	"github.com/zenazn/goji/web"
@@ -18,8 +20,16 @@ import (
 var _ = fmt.Printf
 
 var (
-	UrlsBucket = []byte("urls")
-	LogsBucket = []byte("logs")
+	UrlsBucket       = []byte("urls")
+	LogsBucket       = []byte("logs")
+	SnapshotsBucket  = []byte("snapshots")
+	ChangesBucket    = []byte("changes")
+	DeliveriesBucket = []byte("deliveries")
+	RunsBucket       = []byte("runs")
+
+	FeedEntriesBucket = []byte("feed_entries")
+	ValuesBucket      = []byte("values")
+	LatestBucket      = []byte("latest")
 
 	log = logrus.New()
 )
@@ -38,7 +48,7 @@ func ServeAsset(name, mime string) func(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func TryUpdate(db *bolt.DB, id uint64) {
+func TryUpdate(db *bolt.DB, queue *Queue, id uint64) {
 	// The task may have been deleted from the DB, so we try to fetch it first
 	check := &Check{}
 	found := false
@@ -56,6 +66,7 @@ func TryUpdate(db *bolt.DB, id uint64) {
 			return err
 		}
 
+		check.ID = id
 		found = true
 		return nil
 	})
@@ -72,8 +83,48 @@ func TryUpdate(db *bolt.DB, id uint64) {
 		return
 	}
 
+	if check.Suspended(time.Now()) {
+		log.WithFields(logrus.Fields{
+			"id": id,
+		}).Info("skipping update for paused check")
+		return
+	}
+
 	// Got a check.  Trigger an update.
-	check.Update(db)
+	queueRetry(queue, check.Update(db))
+}
+
+// Returns the host the given check fetches from, or an empty string if the
+// check can't be loaded.
+func CheckHost(db *bolt.DB, id uint64) string {
+	var host string
+	db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(UrlsBucket).Get(KeyFor(id))
+		if data == nil {
+			return nil
+		}
+
+		check := &Check{}
+		if err := json.Unmarshal(data, check); err != nil {
+			return err
+		}
+		if u, err := url.Parse(check.URL); err == nil {
+			host = u.Host
+		}
+		return nil
+	})
+	return host
+}
+
+// Adds (or replaces) the scheduled job for the given check.  The job only
+// queues the check; the queue decides when it actually runs.  Note that we
+// pull out the ID into a new variable so that we don't keep the entire Check
+// structure from being garbage collected.
+func ScheduleCheck(sched *Scheduler, queue *Queue, check *Check) error {
+	id := check.ID
+	return sched.Set(id, check.Schedule, check.Location(), func() {
+		queue.Enqueue(id)
+	})
 }
 
 type ErrorsHook struct {
@@ -140,20 +191,47 @@ func (hook *ErrorsHook) Levels() []logrus.Level {
 }
 
 func main() {
-	dbPath := "./monitor.db"
-	db, err := bolt.Open(dbPath, 0666)
+	config, printConfig, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %s\n", err)
+		os.Exit(1)
+	}
+
+	if printConfig {
+		data, _ := json.MarshalIndent(config, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	config.Apply()
+
+	db, err := bolt.Open(config.DBPath, 0666)
 	if err != nil {
 		log.WithFields(logrus.Fields{
-			"path": dbPath,
+			"path": config.DBPath,
 			"err":  err,
 		}).Fatal("error opening db")
 	}
 	defer db.Close()
 
-	c := cron.New()
+	sched := NewScheduler()
+	var queue *Queue
+	queue = NewQueue(config.QueueLimits(),
+		func(id uint64) { TryUpdate(db, queue, id) },
+		func(id uint64) string { return CheckHost(db, id) })
 
 	// Create collections.
-	buckets := [][]byte{UrlsBucket, LogsBucket}
+	buckets := [][]byte{
+		UrlsBucket,
+		LogsBucket,
+		SnapshotsBucket,
+		ChangesBucket,
+		DeliveriesBucket,
+		RunsBucket,
+		FeedEntriesBucket,
+		ValuesBucket,
+		LatestBucket,
+	}
 	db.Update(func(tx *bolt.Tx) error {
 		for _, v := range buckets {
 			b := tx.Bucket(v)
@@ -170,6 +248,10 @@ func main() {
 		DB: db,
 	})
 
+	if retention := config.RetentionPeriod(); retention > 0 {
+		StartPruning(db, retention)
+	}
+
 	// Initialize for each of the existing URLs
 	var items []*Check
 	if err = GetAllChecks(db, &items); err != nil {
@@ -178,22 +260,33 @@ func main() {
 		}).Fatal("error loading checks")
 	}
 
-	for _, v := range items {
-		// Trigger the update now...
-		go v.Update(db)
+	// Start the queue before anything is added to it.
+	queue.Start()
+	defer queue.Stop()
 
-		// ... and add a cron task for later.  Note that we pull out the ID
-		// into a new variable so that we don't keep the entire Check structure
-		// from being garbage collected.
+	stagger := config.StartupStaggerPeriod()
+	for i, v := range items {
+		// Queue an update now, spreading the checks out so they don't all
+		// start at once...
 		id := v.ID
-		c.AddFunc(v.Schedule, func() {
-			TryUpdate(db, id)
+		time.AfterFunc(time.Duration(i)*stagger, func() {
+			queue.Enqueue(id)
 		})
+
+		// ... and schedule it for later.
+		if err = ScheduleCheck(sched, queue, v); err != nil {
+			log.WithFields(logrus.Fields{
+				"id":        v.ID,
+				"schedule":  v.Schedule,
+				"time_zone": v.TimeZone,
+				"err":       err,
+			}).Error("error scheduling check")
+		}
 	}
 
-	// Start our cron scheduler.
-	c.Start()
-	defer c.Stop()
+	// Start our scheduler.
+	sched.Start()
+	defer sched.Stop()
 
 	mux := web.New()
 
@@ -202,7 +295,8 @@ func main() {
 	mux.Use(RecovererMiddleware)
 	mux.Use(middleware.AutomaticOptions)
 	mux.Use(DbInjectMiddleware(db))
-	mux.Use(CronInjectMiddleware(c))
+	mux.Use(SchedulerInjectMiddleware(sched))
+	mux.Use(QueueInjectMiddleware(queue))
 
 	mux.Get("/", ServeAsset("index.html", "text/html"))
 
@@ -232,9 +326,24 @@ func main() {
 	})
 	api.Get("/api/checks", RouteChecksGetAll)
 	api.Post("/api/checks", RouteChecksNew)
+	api.Post("/api/checks/validate", RouteChecksValidate)
+	api.Post("/api/checks/preview", RouteChecksPreview)
 	api.Patch("/api/checks/:id", RouteChecksModify)
 	api.Delete("/api/checks/:id", RouteChecksDelete)
 	api.Post("/api/checks/:id/update", RouteChecksUpdateOne)
+	api.Post("/api/checks/:id/pause", RouteChecksPause)
+	api.Post("/api/checks/:id/resume", RouteChecksResume)
+	api.Post("/api/checks/:id/snooze", RouteChecksSnooze)
+	api.Get("/api/checks/:id/snapshots", RouteSnapshotsGetAll)
+	api.Get("/api/checks/:id/snapshots/:sid", RouteSnapshotsGetOne)
+	api.Get("/api/checks/:id/changes", RouteChangesGetAll)
+	api.Get("/api/checks/:id/changes/:cid/diff", RouteChangesGetDiff)
+	api.Get("/api/checks/:id/deliveries", RouteDeliveriesGetAll)
+	api.Get("/api/checks/:id/runs", RouteRunsGetAll)
+	api.Get("/api/checks/:id/values", RouteValuesGetAll)
+	api.Get("/api/checks/:id/uptime", RouteUptimeGetOne)
+	api.Get("/api/queue", RouteQueueGet)
+	api.Get("/api/schedule", RouteScheduleGet)
 	api.Get("/api/stats", RouteStatsGetAll)
 	api.Get("/api/logs", RouteLogsGetAll)
 	api.Delete("/api/logs", RouteLogsDeleteAll)
@@ -244,7 +353,12 @@ func main() {
 
 	// We re-create what Goji does to serve here.
 	http.Handle("/", mux)
-	listener := bind.Default()
+	var listener net.Listener
+	if len(config.Bind) > 0 {
+		listener = bind.Socket(config.Bind)
+	} else {
+		listener = bind.Default()
+	}
 	log.Println("starting server on", listener.Addr())
 	bind.Ready()
 
@@ -7,7 +7,6 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
-	"github.com/robfig/cron"
 	"github.com/zenazn/goji/web"
 	"github.com/zenazn/goji/web/middleware"
 )
@@ -23,10 +22,21 @@ func DbInjectMiddleware(db *bolt.DB) func(c *web.C, h http.Handler) http.Handler
 	return middleware
 }
 
-func CronInjectMiddleware(cr *cron.Cron) func(c *web.C, h http.Handler) http.Handler {
+func SchedulerInjectMiddleware(sched *Scheduler) func(c *web.C, h http.Handler) http.Handler {
 	middleware := func(c *web.C, h http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			c.Env["cron"] = cr
+			c.Env["scheduler"] = sched
+			h.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+	return middleware
+}
+
+func QueueInjectMiddleware(queue *Queue) func(c *web.C, h http.Handler) http.Handler {
+	middleware := func(c *web.C, h http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			c.Env["queue"] = queue
 			h.ServeHTTP(w, r)
 		}
 		return http.HandlerFunc(fn)
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"code.google.com/p/cascadia"
+	"code.google.com/p/go.net/html"
+)
+
+// NormalizeOptions holds the rules applied to a content check's extracted
+// values before they're hashed, so that irrelevant differences such as
+// timestamps or tokens don't register as changes.
+type NormalizeOptions struct {
+	// CSS selectors for nodes to remove from the page before the check's
+	// selector is applied.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Regular expressions whose matches are removed.
+	Strip []string `json:"strip,omitempty"`
+
+	// Regular expressions whose matches are replaced.  The replacement may
+	// refer to capture groups as $1, etc.
+	Replace []ReplaceRule `json:"replace,omitempty"`
+
+	// Fold the text to lower case.
+	Lowercase bool `json:"lowercase,omitempty"`
+
+	// Collapse runs of whitespace to a single space, and trim whitespace
+	// from either end.
+	CollapseWhitespace bool `json:"collapse_whitespace,omitempty"`
+}
+
+type ReplaceRule struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// Returns true if any of the options are set.
+func (o *NormalizeOptions) Enabled() bool {
+	return len(o.Exclude) > 0 || len(o.Strip) > 0 || len(o.Replace) > 0 ||
+		o.Lowercase || o.CollapseWhitespace
+}
+
+func (o *NormalizeOptions) Validate() *ValidationError {
+	for i, sel := range o.Exclude {
+		if _, err := cascadia.Compile(sel); err != nil {
+			return &ValidationError{
+				fmt.Sprintf("normalize.exclude[%d]", i),
+				"invalid CSS selector: " + err.Error(),
+			}
+		}
+	}
+	for i, pattern := range o.Strip {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return &ValidationError{
+				fmt.Sprintf("normalize.strip[%d]", i),
+				"invalid regular expression: " + err.Error(),
+			}
+		}
+	}
+	for i, rule := range o.Replace {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return &ValidationError{
+				fmt.Sprintf("normalize.replace[%d]", i),
+				"invalid regular expression: " + err.Error(),
+			}
+		}
+	}
+	return nil
+}
+
+// Applies the text rules to each of the extraction's values, in the order
+// strip, replace, lowercase and collapse whitespace.  Exclusions are applied
+// when the page is parsed, not here.
+func (o *NormalizeOptions) Apply(ext *Extraction) {
+	var strip []*regexp.Regexp
+	for _, pattern := range o.Strip {
+		if re, err := regexp.Compile(pattern); err == nil {
+			strip = append(strip, re)
+		}
+	}
+
+	var replace []*regexp.Regexp
+	var replacements []string
+	for _, rule := range o.Replace {
+		if re, err := regexp.Compile(rule.Pattern); err == nil {
+			replace = append(replace, re)
+			replacements = append(replacements, rule.Replacement)
+		}
+	}
+
+	for i, v := range ext.Values {
+		for _, re := range strip {
+			v = re.ReplaceAllString(v, "")
+		}
+		for j, re := range replace {
+			v = re.ReplaceAllString(v, replacements[j])
+		}
+		if o.Lowercase {
+			v = strings.ToLower(v)
+		}
+		if o.CollapseWhitespace {
+			v = strings.Join(strings.Fields(v), " ")
+		}
+		ext.Values[i] = v
+	}
+	ext.Text = strings.Join(ext.Values, "\n")
+}
+
+// Removes every node matching any of the given CSS selectors from the tree.
+func excludeNodes(root *html.Node, selectors []string) {
+	for _, s := range selectors {
+		sel, err := cascadia.Compile(s)
+		if err != nil {
+			continue
+		}
+		for _, n := range sel.MatchAll(root) {
+			if n.Parent != nil {
+				n.Parent.RemoveChild(n)
+			}
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// How long a single notification delivery may take before it's abandoned.
+const notifyTimeout = 30 * time.Second
+
+// A Notification is the payload sent to each of a check's notifiers when
+// something interesting happens to it.
+type Notification struct {
+	Event      string     `json:"event"`
+	CheckID    uint64     `json:"check_id"`
+	URL        string     `json:"url"`
+	Field      string     `json:"field,omitempty"`
+	Selector   string     `json:"selector"`
+	Time       time.Time  `json:"time"`
+	ChangeID   uint64     `json:"change_id,omitempty"`
+	OldHash    string     `json:"old_hash,omitempty"`
+	NewHash    string     `json:"new_hash,omitempty"`
+	Diff       string     `json:"diff,omitempty"`
+	Conditions []string   `json:"conditions,omitempty"`
+	Entry      *FeedEntry `json:"entry,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Returns a one-line human-readable summary of the notification.
+func (n *Notification) Subject() string {
+	if len(n.Field) > 0 {
+		return fmt.Sprintf("site-monitor: %s in %q for check %d (%s)", n.Event, n.Field, n.CheckID, n.URL)
+	}
+	return fmt.Sprintf("site-monitor: %s for check %d (%s)", n.Event, n.CheckID, n.URL)
+}
+
+// Returns a plain-text body describing the notification.
+func (n *Notification) Body() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Event:    %s\n", n.Event)
+	fmt.Fprintf(&buf, "Check:    %d\n", n.CheckID)
+	fmt.Fprintf(&buf, "URL:      %s\n", n.URL)
+	if len(n.Field) > 0 {
+		fmt.Fprintf(&buf, "Field:    %s\n", n.Field)
+	}
+	fmt.Fprintf(&buf, "Selector: %s\n", n.Selector)
+	fmt.Fprintf(&buf, "Time:     %s\n", n.Time.Format(time.RFC3339))
+	if len(n.Error) > 0 {
+		fmt.Fprintf(&buf, "Error:    %s\n", n.Error)
+	}
+	for _, cond := range n.Conditions {
+		fmt.Fprintf(&buf, "Condition: %s\n", cond)
+	}
+	if n.Entry != nil {
+		fmt.Fprintf(&buf, "\nTitle:     %s\n", n.Entry.Title)
+		fmt.Fprintf(&buf, "Link:      %s\n", n.Entry.Link)
+		if !n.Entry.Published.IsZero() {
+			fmt.Fprintf(&buf, "Published: %s\n", n.Entry.Published.Format(time.RFC3339))
+		}
+	}
+	if len(n.Diff) > 0 {
+		fmt.Fprintf(&buf, "\n%s", n.Diff)
+	}
+	return buf.String()
+}
+
+// A Notifier delivers notifications somewhere.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// The notifier types that can be configured on a check.
+const (
+	NotifierWebhook = "webhook"
+	NotifierEmail   = "email"
+	NotifierExec    = "exec"
+)
+
+// NotifierConfig is the serialized configuration for a single notifier on a
+// check.  Which fields are used depends on Type.
+type NotifierConfig struct {
+	Type string `json:"type"`
+
+	// Webhook
+	URL string `json:"url,omitempty"`
+
+	// Email
+	SMTPServer   string   `json:"smtp_server,omitempty"`
+	SMTPUsername string   `json:"smtp_username,omitempty"`
+	SMTPPassword string   `json:"smtp_password,omitempty"`
+	From         string   `json:"from,omitempty"`
+	To           []string `json:"to,omitempty"`
+
+	// Exec
+	Command string   `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Builds the Notifier described by this configuration, returning an error if
+// the configuration is incomplete.
+func (nc *NotifierConfig) Notifier() (Notifier, error) {
+	switch nc.Type {
+	case NotifierWebhook:
+		if len(nc.URL) == 0 {
+			return nil, fmt.Errorf("webhook notifier requires a url")
+		}
+		return &WebhookNotifier{URL: nc.URL}, nil
+
+	case NotifierEmail:
+		if len(nc.SMTPServer) == 0 {
+			return nil, fmt.Errorf("email notifier requires an smtp_server")
+		}
+		if len(nc.From) == 0 {
+			return nil, fmt.Errorf("email notifier requires a from address")
+		}
+		if len(nc.To) == 0 {
+			return nil, fmt.Errorf("email notifier requires at least one to address")
+		}
+		for _, addr := range append([]string{nc.From}, nc.To...) {
+			if strings.ContainsAny(addr, "\r\n") {
+				return nil, fmt.Errorf("email addresses cannot contain line breaks")
+			}
+		}
+		return &EmailNotifier{
+			Server:   nc.SMTPServer,
+			Username: nc.SMTPUsername,
+			Password: nc.SMTPPassword,
+			From:     nc.From,
+			To:       nc.To,
+		}, nil
+
+	case NotifierExec:
+		if len(nc.Command) == 0 {
+			return nil, fmt.Errorf("exec notifier requires a command")
+		}
+		if !execAllowed(nc.Command) {
+			return nil, fmt.Errorf("command '%s' is not in the server's exec_commands", nc.Command)
+		}
+		return &ExecNotifier{Command: nc.Command, Args: nc.Args}, nil
+	}
+
+	return nil, fmt.Errorf("unknown notifier type: '%s'", nc.Type)
+}
+
+// Returns a short description of where this notifier delivers to, suitable
+// for recording alongside delivery attempts.  Credentials are never included.
+func (nc *NotifierConfig) Target() string {
+	switch nc.Type {
+	case NotifierWebhook:
+		return nc.URL
+	case NotifierEmail:
+		return strings.Join(nc.To, ", ")
+	case NotifierExec:
+		return nc.Command
+	}
+	return ""
+}
+
+// WebhookNotifier POSTs the notification as JSON to a URL.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (wn *WebhookNotifier) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(wn.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// EmailNotifier sends the notification as a plain-text email over SMTP.
+type EmailNotifier struct {
+	Server   string
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (en *EmailNotifier) Notify(n *Notification) error {
+	var auth smtp.Auth
+	if len(en.Username) > 0 {
+		host := en.Server
+		if i := strings.LastIndex(host, ":"); i != -1 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", en.Username, en.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", en.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(en.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", headerValue(n.Subject()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	msg.WriteString(strings.Replace(n.Body(), "\n", "\r\n", -1))
+
+	return smtp.SendMail(en.Server, auth, en.From, en.To, msg.Bytes())
+}
+
+// Replaces line breaks in a mail header value, which could otherwise be used
+// to add headers of their own.
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// The commands that exec notifiers may run, as set by the exec_commands
+// setting.  Exec notifiers are disabled if it's empty, since anyone who can
+// reach the API could otherwise run any command on the server.
+var ExecCommands []string
+
+func execAllowed(command string) bool {
+	for _, allowed := range ExecCommands {
+		if command == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecNotifier runs a local command, passing the notification as JSON on
+// stdin and the most important fields as environment variables.
+type ExecNotifier struct {
+	Command string
+	Args    []string
+}
+
+func (xn *ExecNotifier) Notify(n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(xn.Command, xn.Args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(),
+		"SITE_MONITOR_EVENT="+n.Event,
+		fmt.Sprintf("SITE_MONITOR_CHECK_ID=%d", n.CheckID),
+		"SITE_MONITOR_URL="+n.URL,
+		"SITE_MONITOR_FIELD="+n.Field,
+		"SITE_MONITOR_ERROR="+n.Error,
+		fmt.Sprintf("SITE_MONITOR_CHANGE_ID=%d", n.ChangeID),
+	)
+
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	// Kill the command if it runs for too long.
+	timer := time.AfterFunc(notifyTimeout, func() {
+		cmd.Process.Kill()
+	})
+	err = cmd.Wait()
+	timer.Stop()
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(output.String()))
+	}
+	return nil
+}
+
+// A Delivery records a single attempt to deliver a notification.
+type Delivery struct {
+	ID       uint64    `json:"id"`
+	CheckID  uint64    `json:"check_id"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Type     string    `json:"type"`
+	Target   string    `json:"target"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+	Duration string    `json:"duration"`
+}
+
+// Sorts deliveries by ID, which is also the order they were attempted in.
+type deliveriesByID []*Delivery
+
+func (s deliveriesByID) Len() int           { return len(s) }
+func (s deliveriesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s deliveriesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// Saves the given delivery record, assigning it a new ID.
+func SaveDelivery(db *bolt.DB, d *Delivery) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(DeliveriesBucket).CreateBucketIfNotExists(KeyFor(d.CheckID))
+		if err != nil {
+			return err
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		d.ID = uint64(seq)
+
+		data, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(KeyFor(d.ID), data)
+	})
+}
+
+// Loads all delivery records for the given check, oldest first.
+func GetDeliveries(db *bolt.DB, checkID uint64, output *[]*Delivery) error {
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(DeliveriesBucket).Bucket(KeyFor(checkID))
+		if b == nil {
+			return nil
+		}
+
+		b.ForEach(func(k, v []byte) error {
+			d := &Delivery{}
+			if err := json.Unmarshal(v, d); err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err,
+				}).Error("error unmarshaling json")
+				return nil
+			}
+
+			d.ID = binary.LittleEndian.Uint64(k)
+			*output = append(*output, d)
+			return nil
+		})
+		return nil
+	})
+
+	sort.Sort(deliveriesByID(*output))
+	return err
+}
+
+// Sends the notification to each of the given notifiers in turn, recording
+// the outcome of every attempt.
+func SendNotifications(db *bolt.DB, configs []NotifierConfig, n *Notification) {
+	for _, nc := range configs {
+		d := &Delivery{
+			CheckID: n.CheckID,
+			Time:    time.Now(),
+			Event:   n.Event,
+			Type:    nc.Type,
+			Target:  nc.Target(),
+		}
+
+		notifier, err := nc.Notifier()
+		if err == nil {
+			err = notifier.Notify(n)
+		}
+		d.Duration = time.Since(d.Time).String()
+
+		if err != nil {
+			d.Error = err.Error()
+			log.WithFields(logrus.Fields{
+				"id":     n.CheckID,
+				"type":   nc.Type,
+				"target": d.Target,
+				"err":    err,
+			}).Error("error sending notification")
+		} else {
+			d.Success = true
+		}
+
+		if err = SaveDelivery(db, d); err != nil {
+			log.WithFields(logrus.Fields{
+				"id":  n.CheckID,
+				"err": err,
+			}).Error("error saving delivery record")
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// The conditions that can be placed on a numeric check.  Each is evaluated
+// against the value from the previous run.
+const (
+	ConditionBelow            = "below"
+	ConditionAbove            = "above"
+	ConditionIncreases        = "increases"
+	ConditionDecreases        = "decreases"
+	ConditionChangesBy        = "changes_by"
+	ConditionChangesByPercent = "changes_by_percent"
+)
+
+// NumericOptions turns a check's extracted content into a single number.
+// The number is recorded on every run, and a change is only reported when
+// the number changes and, if there are any conditions, one of them holds.
+type NumericOptions struct {
+	Enabled bool `json:"enabled"`
+
+	// The decimal separator, "." or ",".  If empty, it's guessed from the
+	// number itself, and numbers such as "1,234" that could use either are
+	// rejected.
+	DecimalSeparator string `json:"decimal_separator,omitempty"`
+
+	Conditions []NumericCondition `json:"conditions,omitempty"`
+}
+
+// A NumericCondition is a condition on a numeric check, such as "below 10".
+// Value is unused by the increases and decreases conditions.
+type NumericCondition struct {
+	Kind  string  `json:"kind"`
+	Value float64 `json:"value"`
+}
+
+func (o *NumericOptions) Validate() *ValidationError {
+	if !o.Enabled {
+		return nil
+	}
+
+	switch o.DecimalSeparator {
+	case "", ".", ",":
+	default:
+		return &ValidationError{"numeric.decimal_separator", "decimal separator must be '.' or ','"}
+	}
+
+	for i, cond := range o.Conditions {
+		field := fmt.Sprintf("numeric.conditions[%d]", i)
+		switch cond.Kind {
+		case ConditionBelow, ConditionAbove, ConditionIncreases, ConditionDecreases:
+		case ConditionChangesBy, ConditionChangesByPercent:
+			if cond.Value <= 0 {
+				return &ValidationError{field + ".value", "value must be greater than zero"}
+			}
+		default:
+			return &ValidationError{field + ".kind", "kind must be one of 'below', 'above', " +
+				"'increases', 'decreases', 'changes_by' or 'changes_by_percent'"}
+		}
+	}
+	return nil
+}
+
+// Returns a description of each condition that holds for a change from prev
+// to cur.  Nothing holds if there is no previous value.
+func (o *NumericOptions) Evaluate(prev *float64, cur float64) []string {
+	if prev == nil {
+		return nil
+	}
+	old := *prev
+
+	var held []string
+	for _, cond := range o.Conditions {
+		x := formatNumber(cond.Value)
+		switch cond.Kind {
+		case ConditionBelow:
+			if old >= cond.Value && cur < cond.Value {
+				held = append(held, "dropped below "+x)
+			}
+		case ConditionAbove:
+			if old <= cond.Value && cur > cond.Value {
+				held = append(held, "rose above "+x)
+			}
+		case ConditionIncreases:
+			if cur > old {
+				held = append(held, "increased")
+			}
+		case ConditionDecreases:
+			if cur < old {
+				held = append(held, "decreased")
+			}
+		case ConditionChangesBy:
+			if math.Abs(cur-old) > cond.Value {
+				held = append(held, "changed by more than "+x)
+			}
+		case ConditionChangesByPercent:
+			if old != 0 && math.Abs(cur-old)/math.Abs(old)*100 > cond.Value {
+				held = append(held, "changed by more than "+x+"%")
+			}
+		}
+	}
+	return held
+}
+
+// Matches the first number in some text, including any sign and thousands
+// or decimal separators.  Spaces are only taken as thousands separators when
+// followed by exactly three digits.
+var numberPattern = regexp.MustCompile(`[-+\x{2212}]?\d+(?:[.,'\x{00A0}\x{202F}]\d+| \d{3}\b)*`)
+
+// ParseNumber parses the first number in the given text, ignoring currency
+// symbols and other surrounding text.  The decimal separator may be "." or
+// ","; if empty, it's guessed, and numbers that could be read either way are
+// an error.
+func ParseNumber(text, decimal string) (float64, error) {
+	s := numberPattern.FindString(text)
+	if len(s) == 0 {
+		return 0, fmt.Errorf("no number found")
+	}
+
+	negative := false
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "\u2212") {
+		negative = true
+	}
+	s = strings.TrimLeft(s, "+-\u2212")
+
+	s = strings.NewReplacer(" ", "", "'", "", "\u00a0", "", "\u202f", "").Replace(s)
+	if len(decimal) == 0 {
+		if decimal = guessDecimalSeparator(s); len(decimal) == 0 {
+			return 0, fmt.Errorf("ambiguous number %q: set numeric.decimal_separator to \".\" or \",\"", s)
+		}
+	}
+	thousands := ","
+	if decimal == "," {
+		thousands = "."
+	}
+	s = strings.Replace(s, thousands, "", -1)
+	s = strings.Replace(s, decimal, ".", 1)
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		n = -n
+	}
+	return n, nil
+}
+
+// Guesses the decimal separator of a number made up of digits, dots and
+// commas.  If both separators are used, the last one is the decimal
+// separator, and a separator used more than once is a thousands separator.
+// A single separator followed by exactly three digits could be either, unless
+// the digits before it can't be a thousands group (as in "0.125" or
+// "1234.567"), so an empty string is returned for those.
+func guessDecimalSeparator(s string) string {
+	dot := strings.LastIndex(s, ".")
+	comma := strings.LastIndex(s, ",")
+	switch {
+	case dot < 0 && comma < 0:
+		return "."
+	case dot >= 0 && comma >= 0:
+		if dot > comma {
+			return "."
+		}
+		return ","
+	}
+
+	sep, other, i := ".", ",", dot
+	if comma >= 0 {
+		sep, other, i = ",", ".", comma
+	}
+	if strings.Count(s, sep) > 1 {
+		return other
+	}
+	if len(s)-i-1 != 3 || i > 3 || s[0] == '0' {
+		return sep
+	}
+	return ""
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+// Replaces the extracted text with the number parsed from it, so that it's
+// the number that's hashed and stored.
+func extractNumber(ext *Extraction, o *NumericOptions) (*Extraction, error) {
+	n, err := ParseNumber(ext.Text, o.DecimalSeparator)
+	if err != nil {
+		return ext, &ExtractError{ErrorParse, err}
+	}
+
+	text := formatNumber(n)
+	return &Extraction{
+		Text:    text,
+		HTML:    ext.HTML,
+		Matched: ext.Matched,
+		Values:  []string{text},
+		Number:  &n,
+	}, nil
+}
+
+// A NumericValue is a single point in the time series of a numeric check.
+type NumericValue struct {
+	ID      uint64    `json:"id"`
+	CheckID uint64    `json:"check_id"`
+	Field   string    `json:"field,omitempty"`
+	Time    time.Time `json:"time"`
+	Value   float64   `json:"value"`
+}
+
+// Sorts values by ID, which is also the order they were recorded in.
+type valuesByID []*NumericValue
+
+func (s valuesByID) Len() int           { return len(s) }
+func (s valuesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s valuesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// Saves the given value, assigning it a new ID.
+func SaveValue(db *bolt.DB, value *NumericValue) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(ValuesBucket).CreateBucketIfNotExists(KeyFor(value.CheckID))
+		if err != nil {
+			return err
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		value.ID = uint64(seq)
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put(KeyFor(value.ID), data); err != nil {
+			return err
+		}
+		return setLatest(tx, value.CheckID, ValuesBucket, value.Field, value.ID)
+	})
+}
+
+// Loads the most recent value for the given check and field, or nil if
+// there isn't one.
+func GetLatestValue(db *bolt.DB, checkID uint64, field string) (*NumericValue, error) {
+	var value *NumericValue
+	err := db.View(func(tx *bolt.Tx) error {
+		id, ok := getLatest(tx, checkID, ValuesBucket, field)
+		if !ok {
+			return nil
+		}
+
+		data := tx.Bucket(ValuesBucket).Bucket(KeyFor(checkID)).Get(KeyFor(id))
+		if data == nil {
+			return nil
+		}
+
+		value = &NumericValue{}
+		if err := json.Unmarshal(data, value); err != nil {
+			return err
+		}
+		value.ID = id
+		return nil
+	})
+	if err != nil || value != nil {
+		return value, err
+	}
+
+	// Not indexed, so search the check's whole history.
+	values := []*NumericValue{}
+	if err := GetValues(db, checkID, &values); err != nil {
+		return nil, err
+	}
+
+	for i := len(values) - 1; i >= 0; i-- {
+		if values[i].Field == field {
+			return values[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Loads all values for the given check, oldest first.
+func GetValues(db *bolt.DB, checkID uint64, output *[]*NumericValue) error {
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ValuesBucket).Bucket(KeyFor(checkID))
+		if b == nil {
+			return nil
+		}
+
+		b.ForEach(func(k, v []byte) error {
+			value := &NumericValue{}
+			if err := json.Unmarshal(v, value); err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err,
+				}).Error("error unmarshaling json")
+				return nil
+			}
+
+			value.ID = binary.LittleEndian.Uint64(k)
+			*output = append(*output, value)
+			return nil
+		})
+		return nil
+	})
+
+	sort.Sort(valuesByID(*output))
+	return err
+}
+
+// Returns the numeric options that apply to the given field of the check.
+func (c *Check) numericFor(field string) *NumericOptions {
+	if rule := c.rule(field); rule != nil {
+		return &rule.Numeric
+	}
+	return &c.Numeric
+}
+
+// Adds a value to the time series for the given field of the check,
+// returning the previous value, if any.  Errors are logged but otherwise
+// ignored.
+func (c *Check) recordNumber(db *bolt.DB, field string, n float64) *float64 {
+	var prev *float64
+	last, err := GetLatestValue(db, c.ID, field)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error loading values")
+	} else if last != nil {
+		prev = &last.Value
+	}
+
+	value := &NumericValue{
+		CheckID: c.ID,
+		Field:   field,
+		Time:    time.Now(),
+		Value:   n,
+	}
+	if err := SaveValue(db, value); err != nil {
+		log.WithFields(logrus.Fields{
+			"id":  c.ID,
+			"err": err,
+		}).Error("error saving value")
+	}
+
+	return prev
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		text    string
+		decimal string
+		want    float64
+		ok      bool
+	}{
+		{"42", "", 42, true},
+		{"-3", "", -3, true},
+		{"−3.5", "", -3.5, true},
+		{"0.125", "", 0.125, true},
+		{"0,125", "", 0.125, true},
+		{"3.141", "", 0, false},
+		{"3.141", ".", 3.141, true},
+		{"3.141", ",", 3141, true},
+		{"1,234", "", 0, false},
+		{"1,234", ".", 1234, true},
+		{"1,234", ",", 1.234, true},
+		{"1.234,5", "", 1234.5, true},
+		{"1,234.5", "", 1234.5, true},
+		{"1,234,567", "", 1234567, true},
+		{"1.234.567", "", 1234567, true},
+		{"1234.567", "", 1234.567, true},
+		{"12,5", "", 12.5, true},
+		{"12.50", "", 12.5, true},
+		{"Price: $1,234.56", "", 1234.56, true},
+		{"1 234,5 €", "", 1234.5, true},
+		{"1'234.5", "", 1234.5, true},
+		{"no number", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseNumber(tt.text, tt.decimal)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseNumber(%q, %q) = %v, %v, want %v, ok %v", tt.text, tt.decimal, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueueLimits controls how many checks the queue runs at once.
+type QueueLimits struct {
+	// The maximum number of checks running at once, overall and against
+	// any one host.
+	MaxConcurrent int
+	MaxPerHost    int
+
+	// The minimum time between starting two checks against the same host.
+	HostInterval time.Duration
+}
+
+// A QueuedCheck is a check waiting in, or being run by, the queue.  Started
+// is nil until the check starts running.
+type QueuedCheck struct {
+	CheckID uint64     `json:"check_id"`
+	Host    string     `json:"host"`
+	Queued  time.Time  `json:"queued"`
+	Started *time.Time `json:"started,omitempty"`
+
+	// Set for checks added by Run, to be called instead of the queue's run
+	// function, and closed once it returns.
+	fn   func()
+	done chan struct{}
+}
+
+// QueueStatus is a snapshot of the queue's state.  Pending checks are listed
+// in the order they were queued, and in-flight ones in the order they
+// started.
+type QueueStatus struct {
+	MaxConcurrent int            `json:"max_concurrent"`
+	MaxPerHost    int            `json:"max_per_host"`
+	HostInterval  string         `json:"host_interval"`
+	Depth         int            `json:"depth"`
+	Running       int            `json:"running"`
+	Pending       []*QueuedCheck `json:"pending"`
+	InFlight      []*QueuedCheck `json:"in_flight"`
+}
+
+type byStarted []*QueuedCheck
+
+func (a byStarted) Len() int           { return len(a) }
+func (a byStarted) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStarted) Less(i, j int) bool { return a[i].Started.Before(*a[j].Started) }
+
+// A Queue runs checks in the order they're queued, subject to its limits.
+// Checks that can't start yet, because their host is busy or was used too
+// recently, don't hold up checks against other hosts.
+type Queue struct {
+	limits  QueueLimits
+	run     func(id uint64)
+	hostFor func(id uint64) string
+
+	mu          sync.Mutex
+	pending     []*QueuedCheck
+	running     map[uint64]*QueuedCheck
+	hostRunning map[string]int
+	hostLast    map[string]time.Time
+	delayed     map[uint64]*time.Timer
+
+	wake chan struct{}
+	stop chan struct{}
+}
+
+// Creates a queue that calls run to run each check, and hostFor to find the
+// host a check runs against.
+func NewQueue(limits QueueLimits, run func(id uint64), hostFor func(id uint64) string) *Queue {
+	return &Queue{
+		limits:      limits,
+		run:         run,
+		hostFor:     hostFor,
+		running:     make(map[uint64]*QueuedCheck),
+		hostRunning: make(map[string]int),
+		hostLast:    make(map[string]time.Time),
+		delayed:     make(map[uint64]*time.Timer),
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Adds a check to the end of the queue.  A check that's already waiting
+// isn't queued again.
+func (q *Queue) Enqueue(id uint64) {
+	host := q.hostFor(id)
+
+	q.mu.Lock()
+	for _, qc := range q.pending {
+		if qc.CheckID == id && qc.fn == nil {
+			q.mu.Unlock()
+			return
+		}
+	}
+	q.pending = append(q.pending, &QueuedCheck{
+		CheckID: id,
+		Host:    host,
+		Queued:  time.Now(),
+	})
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// Adds a check to the end of the queue once the given delay is up, replacing
+// any delay it was already waiting on.
+func (q *Queue) EnqueueAfter(id uint64, d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if t := q.delayed[id]; t != nil {
+		t.Stop()
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		q.mu.Lock()
+		current := q.delayed[id] == t
+		if current {
+			delete(q.delayed, id)
+		}
+		q.mu.Unlock()
+
+		if current {
+			q.Enqueue(id)
+		}
+	})
+	q.delayed[id] = t
+}
+
+// Runs fn for the given check as soon as the limits allow, ahead of any
+// checks already waiting, and waits for it to return.  This is for runs that
+// someone is waiting on, such as manual updates, which still have to take
+// their turn against the check's host.  Returns false without running fn if
+// the queue is stopped first.
+func (q *Queue) Run(id uint64, fn func()) bool {
+	qc := &QueuedCheck{
+		CheckID: id,
+		Host:    q.hostFor(id),
+		Queued:  time.Now(),
+		fn:      fn,
+		done:    make(chan struct{}),
+	}
+
+	q.mu.Lock()
+	q.pending = append([]*QueuedCheck{qc}, q.pending...)
+	q.mu.Unlock()
+
+	q.signal()
+
+	select {
+	case <-qc.done:
+		return true
+	case <-q.stop:
+		if q.removePending(qc) {
+			return false
+		}
+
+		// It had already started, so let it finish.
+		<-qc.done
+		return true
+	}
+}
+
+// Removes the given entry from the queue, returning false if it isn't
+// waiting.
+func (q *Queue) removePending(qc *QueuedCheck) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, p := range q.pending {
+		if p == qc {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Removes a check from the queue, if it's waiting or delayed.  A running
+// check is left to finish, as are runs someone is waiting on.
+func (q *Queue) Remove(id uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if t := q.delayed[id]; t != nil {
+		t.Stop()
+		delete(q.delayed, id)
+	}
+
+	for i, qc := range q.pending {
+		if qc.CheckID == id && qc.fn == nil {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (q *Queue) Start() {
+	go q.loop()
+}
+
+// Stops starting checks and drops delayed ones.  Checks that are already
+// running are left to finish.
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	for id, t := range q.delayed {
+		t.Stop()
+		delete(q.delayed, id)
+	}
+	q.mu.Unlock()
+
+	close(q.stop)
+}
+
+func (q *Queue) Status() *QueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := &QueueStatus{
+		MaxConcurrent: q.limits.MaxConcurrent,
+		MaxPerHost:    q.limits.MaxPerHost,
+		HostInterval:  q.limits.HostInterval.String(),
+		Depth:         len(q.pending),
+		Running:       len(q.running),
+		Pending:       []*QueuedCheck{},
+		InFlight:      []*QueuedCheck{},
+	}
+	for _, qc := range q.pending {
+		c := *qc
+		status.Pending = append(status.Pending, &c)
+	}
+	for _, qc := range q.running {
+		c := *qc
+		status.InFlight = append(status.InFlight, &c)
+	}
+	sort.Sort(byStarted(status.InFlight))
+	return status
+}
+
+// Wakes the dispatch loop, if it isn't already due to wake.
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) loop() {
+	for {
+		var timer <-chan time.Time
+		if wait := q.dispatch(); wait > 0 {
+			timer = time.After(wait)
+		}
+
+		select {
+		case <-q.wake:
+		case <-timer:
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Starts as many waiting checks as the limits allow.  Returns how long until
+// a host's interval will allow a waiting check to start, or zero if no check
+// is waiting on an interval.
+func (q *Queue) dispatch() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	var remaining []*QueuedCheck
+
+	// Forget hosts whose interval is over, so that hosts that are no
+	// longer checked don't accumulate.
+	for host, last := range q.hostLast {
+		if now.Sub(last) >= q.limits.HostInterval {
+			delete(q.hostLast, host)
+		}
+	}
+
+	for _, qc := range q.pending {
+		if len(q.running) >= q.limits.MaxConcurrent ||
+			q.running[qc.CheckID] != nil ||
+			q.hostRunning[qc.Host] >= q.limits.MaxPerHost {
+			remaining = append(remaining, qc)
+			continue
+		}
+
+		if last, ok := q.hostLast[qc.Host]; ok {
+			if d := last.Add(q.limits.HostInterval).Sub(now); d > 0 {
+				if wait == 0 || d < wait {
+					wait = d
+				}
+				remaining = append(remaining, qc)
+				continue
+			}
+		}
+
+		started := now
+		qc.Started = &started
+		q.running[qc.CheckID] = qc
+		q.hostRunning[qc.Host]++
+		q.hostLast[qc.Host] = now
+		go q.execute(qc)
+	}
+
+	q.pending = remaining
+	return wait
+}
+
+func (q *Queue) execute(qc *QueuedCheck) {
+	defer func() {
+		q.mu.Lock()
+		delete(q.running, qc.CheckID)
+		if q.hostRunning[qc.Host]--; q.hostRunning[qc.Host] <= 0 {
+			delete(q.hostRunning, qc.Host)
+		}
+		q.mu.Unlock()
+
+		q.signal()
+	}()
+
+	if qc.fn != nil {
+		defer close(qc.done)
+		qc.fn()
+		return
+	}
+	q.run(qc.CheckID)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Secrets in a check are replaced by this placeholder in API output and logs.
+// A check that's modified with the placeholder in place of a secret keeps its
+// stored secret.  Secrets are the fetch credentials, cookies and credential
+// headers, and notifiers' SMTP passwords.
+const redactedSecret = "********"
+
+func redact(secret string) string {
+	if len(secret) == 0 {
+		return secret
+	}
+	return redactedSecret
+}
+
+// Request headers whose values are credentials.
+var secretHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// Returns a copy of the options with their credentials replaced by the
+// placeholder.
+func (o FetchOptions) redacted() FetchOptions {
+	o.Password = redact(o.Password)
+	o.BearerToken = redact(o.BearerToken)
+
+	if o.Cookies != nil {
+		cookies := make(map[string]string, len(o.Cookies))
+		for name, value := range o.Cookies {
+			cookies[name] = redact(value)
+		}
+		o.Cookies = cookies
+	}
+	if o.Headers != nil {
+		headers := make(map[string]string, len(o.Headers))
+		for name, value := range o.Headers {
+			if secretHeaders[http.CanonicalHeaderKey(name)] {
+				value = redact(value)
+			}
+			headers[name] = value
+		}
+		o.Headers = headers
+	}
+	if u, err := url.Parse(o.Proxy); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			// The URL package escapes the placeholder's asterisks, so add
+			// it back in by hand.
+			u.User = url.UserPassword(u.User.Username(), "")
+			o.Proxy = strings.Replace(u.String(), ":@", ":"+redactedSecret+"@", 1)
+		}
+	}
+	return o
+}
+
+// Replaces placeholders among the options' credentials with the old
+// options' credentials.
+func (o *FetchOptions) restoreSecrets(old *FetchOptions) *ValidationError {
+	restore := func(field string, secret *string, oldSecret string, ok bool) *ValidationError {
+		if *secret != redactedSecret {
+			return nil
+		}
+		if !ok || len(oldSecret) == 0 {
+			return &ValidationError{"fetch." + field, field + " must be given in full"}
+		}
+		*secret = oldSecret
+		return nil
+	}
+
+	if err := restore("password", &o.Password, old.Password, true); err != nil {
+		return err
+	}
+	if err := restore("bearer_token", &o.BearerToken, old.BearerToken, true); err != nil {
+		return err
+	}
+	for name, value := range o.Cookies {
+		oldValue, ok := old.Cookies[name]
+		if err := restore("cookies", &value, oldValue, ok); err != nil {
+			return err
+		}
+		o.Cookies[name] = value
+	}
+	for name, value := range o.Headers {
+		if !secretHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		oldValue, ok := old.Headers[name]
+		if err := restore("headers", &value, oldValue, ok); err != nil {
+			return err
+		}
+		o.Headers[name] = value
+	}
+
+	if u, err := url.Parse(o.Proxy); err == nil && u.User != nil {
+		password, _ := u.User.Password()
+		if password == redactedSecret {
+			var oldPassword string
+			oldURL, err := url.Parse(old.Proxy)
+			if err == nil && oldURL.User != nil && oldURL.User.Username() == u.User.Username() {
+				oldPassword, _ = oldURL.User.Password()
+			}
+			if len(oldPassword) == 0 {
+				return &ValidationError{"fetch.proxy", fmt.Sprintf("the proxy password for %s must be given in full", u.User.Username())}
+			}
+			u.User = url.UserPassword(u.User.Username(), oldPassword)
+			o.Proxy = u.String()
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the check with its secrets replaced by the placeholder,
+// for API output and logs.
+func (c *Check) Redacted() *Check {
+	rc := *c
+	rc.Fetch = c.Fetch.redacted()
+
+	rc.Notifiers = make([]NotifierConfig, len(c.Notifiers))
+	for i, nc := range c.Notifiers {
+		nc.SMTPPassword = redact(nc.SMTPPassword)
+		rc.Notifiers[i] = nc
+	}
+	return &rc
+}
+
+// Replaces any placeholders among the check's secrets with the secrets they
+// stand for in the old version of the check.  Notifiers are matched by
+// position and type.  Returns an error if a placeholder has nothing to stand
+// for.
+func (c *Check) restoreSecrets(old *Check) *ValidationError {
+	if err := c.Fetch.restoreSecrets(&old.Fetch); err != nil {
+		return err
+	}
+
+	for i := range c.Notifiers {
+		nc := &c.Notifiers[i]
+		if nc.SMTPPassword != redactedSecret {
+			continue
+		}
+		if i >= len(old.Notifiers) || old.Notifiers[i].Type != nc.Type {
+			return &ValidationError{"notifiers", "smtp_password must be given in full for new notifiers"}
+		}
+		nc.SMTPPassword = old.Notifiers[i].SMTPPassword
+	}
+	return nil
+}
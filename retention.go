@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// How often old records are pruned.
+const pruneInterval = time.Hour
+
+// Deletes run, delivery and numeric value records, and error log entries,
+// from before the given time.  Snapshots and changes are kept, since they're the history of
+// the checks themselves.
+func PruneHistory(db *bolt.DB, before time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		err := pruneNested(tx.Bucket(RunsBucket), func(v []byte) bool {
+			run := &Run{}
+			return json.Unmarshal(v, run) == nil && run.Start.Before(before)
+		}, func(name []byte, n int) error {
+			return addCount(tx, binary.LittleEndian.Uint64(name), RunsBucket, -n, nil)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = pruneNested(tx.Bucket(DeliveriesBucket), func(v []byte) bool {
+			d := &Delivery{}
+			return json.Unmarshal(v, d) == nil && d.Time.Before(before)
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		err = pruneNested(tx.Bucket(ValuesBucket), func(v []byte) bool {
+			value := &NumericValue{}
+			return json.Unmarshal(v, value) == nil && value.Time.Before(before)
+		}, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = pruneBucket(tx.Bucket(LogsBucket), func(v []byte) bool {
+			entry := &ErrorLog{}
+			if json.Unmarshal(v, entry) != nil {
+				return false
+			}
+			t, err := time.Parse(time.RFC3339, entry.Time)
+			return err == nil && t.Before(before)
+		})
+		return err
+	})
+}
+
+// Prunes each per-check bucket nested inside the given bucket.  If pruned
+// isn't nil, it's called with the name of each bucket records were deleted
+// from and how many were.
+func pruneNested(b *bolt.Bucket, expired func(v []byte) bool, pruned func(name []byte, n int) error) error {
+	var names [][]byte
+	b.ForEach(func(k, v []byte) error {
+		// Nested buckets have a nil value.
+		if v == nil {
+			names = append(names, k)
+		}
+		return nil
+	})
+
+	for _, name := range names {
+		n, err := pruneBucket(b.Bucket(name), expired)
+		if err != nil {
+			return err
+		}
+		if n > 0 && pruned != nil {
+			if err := pruned(name, n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Deletes the records in the bucket that have expired, returning how many
+// were deleted.
+func pruneBucket(b *bolt.Bucket, expired func(v []byte) bool) (int, error) {
+	// Collect keys first, since we can't modify the bucket while iterating.
+	var keys [][]byte
+	b.ForEach(func(k, v []byte) error {
+		if v != nil && expired(v) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// Prunes records older than the retention period now, and then periodically
+// for as long as the program runs.
+func StartPruning(db *bolt.DB, retention time.Duration) {
+	prune := func() {
+		if err := PruneHistory(db, time.Now().Add(-retention)); err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("error pruning history")
+		}
+	}
+
+	prune()
+	go func() {
+		for _ = range time.Tick(pruneInterval) {
+			prune()
+		}
+	}()
+}
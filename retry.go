@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// The limits on a retry policy.  Backoffs are capped so that a check can't
+// hold a retry pending indefinitely.
+const (
+	maxRetryAttempts = 10
+	maxRetryBackoff  = 10 * time.Minute
+)
+
+// The defaults for a retry policy's settings.
+var (
+	defaultRetryBackoff     = time.Second
+	defaultRetryMaxBackoff  = time.Minute
+	defaultRetryClasses     = []string{ErrorTimeout, ErrorDNS, ErrorConnection}
+	defaultRetryStatusCodes = []int{429, 502, 503, 504}
+)
+
+// The error classes that a fetch can fail with, and so that can be retried.
+var retryableClasses = map[string]bool{
+	ErrorTimeout:    true,
+	ErrorDNS:        true,
+	ErrorConnection: true,
+	ErrorTLS:        true,
+	ErrorFetch:      true,
+}
+
+// RetryPolicy controls how a check retries a failed fetch before giving up
+// until its next scheduled run.  Each retry is a separate run, queued once
+// its delay is up.  The delay before each retry doubles from Backoff up to
+// MaxBackoff, but a longer Retry-After header is honoured.  The zero value
+// never retries.
+type RetryPolicy struct {
+	// The total number of attempts, including the first.  Zero or one
+	// disables retrying.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+
+	// Duration strings, such as "2s", of at most ten minutes.  If empty,
+	// the defaults of one second and one minute are used.
+	Backoff    string `json:"backoff,omitempty"`
+	MaxBackoff string `json:"max_backoff,omitempty"`
+
+	// The error classes and status codes that are retried.  If empty,
+	// timeouts, DNS and connection errors, and statuses 429, 502, 503 and
+	// 504 are retried.
+	ErrorClasses []string `json:"error_classes,omitempty"`
+	StatusCodes  []int    `json:"status_codes,omitempty"`
+}
+
+func (p *RetryPolicy) Validate() *ValidationError {
+	if p.MaxAttempts < 0 || p.MaxAttempts > maxRetryAttempts {
+		return &ValidationError{"retry.max_attempts", fmt.Sprintf("max_attempts must be between 0 and %d", maxRetryAttempts)}
+	}
+	for _, f := range []struct {
+		Name  string
+		Value string
+	}{
+		{"backoff", p.Backoff},
+		{"max_backoff", p.MaxBackoff},
+	} {
+		if len(f.Value) == 0 {
+			continue
+		}
+		d, err := time.ParseDuration(f.Value)
+		if err != nil {
+			return &ValidationError{"retry." + f.Name, err.Error()}
+		}
+		if d <= 0 {
+			return &ValidationError{"retry." + f.Name, f.Name + " must be positive"}
+		}
+		if d > maxRetryBackoff {
+			return &ValidationError{"retry." + f.Name, f.Name + " cannot be more than " + maxRetryBackoff.String()}
+		}
+	}
+	if p.maxBackoff() < p.backoff() {
+		return &ValidationError{"retry.max_backoff", "max_backoff cannot be less than backoff"}
+	}
+	for _, class := range p.ErrorClasses {
+		if !retryableClasses[class] {
+			return &ValidationError{"retry.error_classes", "unknown error class: " + class}
+		}
+	}
+	for _, code := range p.StatusCodes {
+		if code < 100 || code > 599 {
+			return &ValidationError{"retry.status_codes", fmt.Sprintf("invalid status code: %d", code)}
+		}
+	}
+	return nil
+}
+
+// Returns true if the policy retries at all.
+func (p *RetryPolicy) Enabled() bool {
+	return p.MaxAttempts > 1
+}
+
+func (p *RetryPolicy) backoff() time.Duration {
+	if d, err := time.ParseDuration(p.Backoff); err == nil && d > 0 && d <= maxRetryBackoff {
+		return d
+	}
+	return defaultRetryBackoff
+}
+
+func (p *RetryPolicy) maxBackoff() time.Duration {
+	if d, err := time.ParseDuration(p.MaxBackoff); err == nil && d > 0 && d <= maxRetryBackoff {
+		return d
+	}
+	return defaultRetryMaxBackoff
+}
+
+// Returns true if fetches that fail with the given error class are retried.
+func (p *RetryPolicy) retriesClass(class string) bool {
+	classes := p.ErrorClasses
+	if len(classes) == 0 {
+		classes = defaultRetryClasses
+	}
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if responses with the given status code are retried.
+func (p *RetryPolicy) retriesStatus(code int) bool {
+	codes := p.StatusCodes
+	if len(codes) == 0 {
+		codes = defaultRetryStatusCodes
+	}
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how long to wait after the given attempt (counting from one)
+// before the next.  The server's Retry-After, if given, is honoured unless
+// it's longer than MaxBackoff, in which case false is returned and the run
+// should give up.
+func (p *RetryPolicy) delay(attempt int, retryAfter time.Duration) (time.Duration, bool) {
+	max := p.maxBackoff()
+	if retryAfter > max {
+		return 0, false
+	}
+
+	d := p.backoff()
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if retryAfter > d {
+		d = retryAfter
+	}
+	return d, true
+}
+
+// Parses a Retry-After header, which gives either a number of seconds or an
+// HTTP date.  Returns zero if the header is missing or invalid.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Decides whether a failed run should be retried, according to the check's
+// retry policy, and if so sets the run's RetryAt.  RetryAfter is the delay
+// the server asked for, if any.
+func (c *Check) planRetry(run *Run, retryAfter time.Duration) {
+	if !c.Retry.Enabled() || run.Succeeded() {
+		return
+	}
+	if run.ErrorClass == ErrorStatus {
+		if !c.Retry.retriesStatus(run.StatusCode) {
+			return
+		}
+	} else if !c.Retry.retriesClass(run.ErrorClass) {
+		return
+	}
+	if run.Attempt >= c.Retry.MaxAttempts {
+		return
+	}
+
+	d, ok := c.Retry.delay(run.Attempt, retryAfter)
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"id":          c.ID,
+			"retry_after": retryAfter,
+		}).Warn("not retrying check: Retry-After exceeds max_backoff")
+		return
+	}
+
+	at := time.Now().Add(d)
+	run.RetryAt = &at
+
+	log.WithFields(logrus.Fields{
+		"id":      c.ID,
+		"attempt": run.Attempt,
+		"delay":   d,
+		"err":     run.Error,
+	}).Warn("retrying check")
+}
+
+// Queues the run's check again once its retry is due, if it's to be retried.
+func queueRetry(queue *Queue, run *Run) {
+	if run.RetryAt != nil {
+		queue.EnqueueAfter(run.CheckID, run.RetryAt.Sub(time.Now()))
+	}
+}
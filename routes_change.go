@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+// Lists a check's changes.  The "field" query parameter limits the list to
+// the changes of a single extraction rule.  Diffs aren't included, except for
+// changes recorded by older versions; use the diff endpoint.
+func RouteChangesGetAll(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changes := []*Change{}
+	err = GetChanges(db, id, &changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if field, ok := r.URL.Query()["field"]; ok {
+		filtered := []*Change{}
+		for _, change := range changes {
+			if change.Field == field[0] {
+				filtered = append(filtered, change)
+			}
+		}
+		changes = filtered
+	}
+
+	json.NewEncoder(w).Encode(changes)
+}
+
+// Returns the diff for a single change.  The "format" query parameter selects
+// between structured JSON (the default) and a plain-text unified diff, and
+// "granularity" selects between a line-level (the default) and word-level
+// diff.  Diffs are computed on demand from the stored snapshots.
+func RouteChangesGetDiff(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cid, err := strconv.ParseUint(c.URLParams["cid"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "unified" {
+		http.Error(w, "format must be one of 'json' or 'unified'", http.StatusBadRequest)
+		return
+	}
+
+	granularity := r.URL.Query().Get("granularity")
+	if granularity == "" {
+		granularity = "line"
+	}
+	if granularity != "line" && granularity != "word" {
+		http.Error(w, "granularity must be one of 'line' or 'word'", http.StatusBadRequest)
+		return
+	}
+	if format == "unified" && granularity != "line" {
+		http.Error(w, "unified diffs are only available at line granularity", http.StatusBadRequest)
+		return
+	}
+
+	change, err := GetChange(db, id, cid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var ops []DiffOp
+	switch {
+	case granularity == "word" && change.Entry != nil:
+		ops = Diff(nil, SplitWords(change.Entry.String()))
+	case granularity == "word":
+		oldText, newText, err := change.texts(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ops = Diff(SplitWords(oldText), SplitWords(newText))
+	default:
+		if err := change.LoadDiff(db); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ops = change.Diff
+	}
+
+	if format == "unified" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, change.UnifiedDiff())
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"change_id":       change.ID,
+		"old_snapshot_id": change.OldSnapshotID,
+		"new_snapshot_id": change.NewSnapshotID,
+		"granularity":     granularity,
+		"magnitude":       change.Magnitude,
+		"ops":             ops,
+	})
+}
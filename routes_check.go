@@ -3,17 +3,48 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
-	"github.com/robfig/cron"
 	"github.com/zenazn/goji/web"
 )
 
+// The maximum number of characters of extracted text returned by a dry run.
+const validatePreviewLength = 500
+
+// A check along with when it will next run and when it last ran.  NextRun
+// skips runs that will be skipped because the check is paused or snoozed, and
+// is nil if there are none.  PrevRun is nil if the check has never run.
+type scheduledCheck struct {
+	*Check
+	NextRun *time.Time `json:"next_run,omitempty"`
+	PrevRun *time.Time `json:"prev_run,omitempty"`
+}
+
+// Returns when the check's schedule will next actually run it.
+func nextRun(sched *Scheduler, check *Check) (time.Time, bool) {
+	if check.Paused {
+		return time.Time{}, false
+	}
+
+	next, ok := sched.Next(check.ID)
+	if ok && check.Suspended(next) {
+		times := sched.Upcoming(check.ID, check.SnoozedUntil.Add(-time.Nanosecond), time.Time{}, 1)
+		if len(times) == 0 {
+			return time.Time{}, false
+		}
+		next = times[0]
+	}
+	return next, ok
+}
+
 func RouteChecksGetAll(c web.C, w http.ResponseWriter, r *http.Request) {
 	db := c.Env["db"].(*bolt.DB)
+	sched := c.Env["scheduler"].(*Scheduler)
 
 	checks := []*Check{}
 	err := GetAllChecks(db, &checks)
@@ -22,7 +53,19 @@ func RouteChecksGetAll(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(checks)
+	output := []*scheduledCheck{}
+	for _, check := range checks {
+		sc := &scheduledCheck{Check: check.Redacted()}
+		if next, ok := nextRun(sched, check); ok {
+			sc.NextRun = &next
+		}
+		if run, err := GetLatestRun(db, check.ID); err == nil && run != nil {
+			sc.PrevRun = &run.Start
+		}
+		output = append(output, sc)
+	}
+
+	err = json.NewEncoder(w).Encode(output)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -33,9 +76,26 @@ func RouteChecksNew(c web.C, w http.ResponseWriter, r *http.Request) {
 	db := c.Env["db"].(*bolt.DB)
 
 	params := struct {
-		URL      string `json:"url"`
-		Selector string `json:"selector"`
-		Schedule string `json:"schedule"`
+		Type      string             `json:"type"`
+		URL       string             `json:"url"`
+		Mode      string             `json:"mode"`
+		Selector  string             `json:"selector"`
+		Regex     string             `json:"regex"`
+		Value     string             `json:"value"`
+		Attribute string             `json:"attribute"`
+		Schedule  string             `json:"schedule"`
+		TimeZone  string             `json:"time_zone"`
+		Normalize NormalizeOptions   `json:"normalize"`
+		Numeric   NumericOptions     `json:"numeric"`
+		Keywords  []KeywordCondition `json:"keywords"`
+		MinChange ChangeThreshold    `json:"min_change"`
+		Rules     []Rule             `json:"rules"`
+		Fetch     FetchOptions       `json:"fetch"`
+		Retry     RetryPolicy        `json:"retry"`
+		Uptime    UptimeOptions      `json:"uptime"`
+		Notifiers []NotifierConfig   `json:"notifiers"`
+
+		FailureThreshold int `json:"failure_threshold"`
 	}{}
 
 	err := json.NewDecoder(r.Body).Decode(&params)
@@ -44,24 +104,38 @@ func RouteChecksNew(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(params.URL) == 0 {
-		http.Error(w, "missing URL parameter", http.StatusBadRequest)
-		return
+	check := Check{
+		Type:      params.Type,
+		URL:       params.URL,
+		Mode:      params.Mode,
+		Selector:  params.Selector,
+		Regex:     params.Regex,
+		Value:     params.Value,
+		Attribute: params.Attribute,
+		Schedule:  params.Schedule,
+		TimeZone:  params.TimeZone,
+		Normalize: params.Normalize,
+		Numeric:   params.Numeric,
+		Keywords:  params.Keywords,
+		MinChange: params.MinChange,
+		Rules:     params.Rules,
+		Fetch:     params.Fetch,
+		Retry:     params.Retry,
+		Uptime:    params.Uptime,
+		Notifiers: params.Notifiers,
+
+		FailureThreshold: params.FailureThreshold,
+		HashVersion:      currentHashVersion,
 	}
-	if len(params.Selector) == 0 {
-		http.Error(w, "missing Selector parameter", http.StatusBadRequest)
+	if verr := check.restoreSecrets(&Check{}); verr != nil {
+		WriteValidationError(w, verr)
 		return
 	}
-	if len(params.Schedule) == 0 {
-		http.Error(w, "missing Schedule parameter", http.StatusBadRequest)
+	if verr := check.Validate(); verr != nil {
+		WriteValidationError(w, verr)
 		return
 	}
-
-	check := Check{
-		URL:      params.URL,
-		Selector: params.Selector,
-		Schedule: params.Schedule,
-	}
+	check.SetDefaults()
 
 	err = db.Update(func(tx *bolt.Tx) error {
 		data, err := json.Marshal(check)
@@ -86,23 +160,146 @@ func RouteChecksNew(c web.C, w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"err":   err,
-			"check": check,
+			"check": check.Redacted(),
 		}).Error("error inserting new item")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// If we succeeded, we update right now...
-	check.Update(db)
+	queue := c.Env["queue"].(*Queue)
+	queue.Run(check.ID, func() { queueRetry(queue, check.Update(db)) })
 
-	// ... and add a new Cron callback
-	cr := c.Env["cron"].(*cron.Cron)
-	cr.AddFunc(check.Schedule, func() {
-		TryUpdate(db, check.ID)
-	})
+	// ... and schedule it for later.
+	// (The schedule has already been validated, so this can't fail.)
+	sched := c.Env["scheduler"].(*Scheduler)
+	ScheduleCheck(sched, queue, &check)
 
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(check)
+	json.NewEncoder(w).Encode(check.Redacted())
+}
+
+// Validates a check without saving it, then fetches the page once and
+// reports how many nodes the selector matched along with a preview of the
+// extracted text.  The schedule is optional here.  For uptime checks, the
+// result of the uptime assertions is reported instead.
+func RouteChecksValidate(c web.C, w http.ResponseWriter, r *http.Request) {
+	check := &Check{}
+	err := json.NewDecoder(r.Body).Decode(check)
+	if err != nil {
+		http.Error(w, "bad input JSON", http.StatusBadRequest)
+		return
+	}
+
+	if verr := check.validate(false); verr != nil {
+		WriteValidationError(w, verr)
+		return
+	}
+
+	start := time.Now()
+	resp, err := Fetch(check.URL, &check.Fetch)
+	if err != nil {
+		WriteValidationError(w, &ValidationError{"url", "error fetching URL: " + err.Error()})
+		return
+	}
+
+	if check.Type == CheckUptime {
+		run := &Run{
+			Start:          start,
+			ResponseTimeMs: int64(time.Since(start) / time.Millisecond),
+			StatusCode:     resp.StatusCode,
+		}
+		check.Uptime.Assert(run, resp)
+
+		json.NewEncoder(w).Encode(run)
+		return
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		WriteValidationError(w, &ValidationError{"url", "error fetching URL: " + err.Error()})
+		return
+	}
+	data, encoding := DecodeBody(data, resp.Header.Get("Content-Type"))
+
+	result := map[string]interface{}{
+		"status_code": resp.StatusCode,
+		"encoding":    encoding,
+		"matched":     0,
+		"preview":     "",
+	}
+
+	ext, err := check.Extract(data)
+	if ext != nil {
+		preview := ext.Text
+		if runes := []rune(preview); len(runes) > validatePreviewLength {
+			preview = string(runes[:validatePreviewLength])
+		}
+
+		result["matched"] = ext.Matched
+		result["preview"] = preview
+	}
+	if err != nil {
+		result["error"] = err.Error()
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// Fetches the page for an unsaved check and shows its content both as
+// selected and after normalisation, so that normalisation rules can be tried
+// out before they're saved.
+func RouteChecksPreview(c web.C, w http.ResponseWriter, r *http.Request) {
+	check := &Check{}
+	err := json.NewDecoder(r.Body).Decode(check)
+	if err != nil {
+		http.Error(w, "bad input JSON", http.StatusBadRequest)
+		return
+	}
+
+	if verr := check.validate(false); verr != nil {
+		WriteValidationError(w, verr)
+		return
+	}
+	if check.Type == CheckUptime {
+		WriteValidationError(w, &ValidationError{"type", "uptime checks have no content to preview"})
+		return
+	}
+
+	resp, err := Fetch(check.URL, &check.Fetch)
+	if err != nil {
+		WriteValidationError(w, &ValidationError{"url", "error fetching URL: " + err.Error()})
+		return
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		WriteValidationError(w, &ValidationError{"url", "error fetching URL: " + err.Error()})
+		return
+	}
+	data, encoding := DecodeBody(data, resp.Header.Get("Content-Type"))
+
+	result := map[string]interface{}{
+		"status_code": resp.StatusCode,
+		"encoding":    encoding,
+	}
+
+	if raw, err := check.extract(data, nil); err == nil {
+		result["text"] = raw.Text
+	}
+
+	ext, err := check.Extract(data)
+	if err != nil {
+		result["error"] = err.Error()
+	} else {
+		result["normalized"] = ext.Text
+		result["values"] = ext.Values
+		result["hash"] = HashText(ext.Text)
+	}
+
+	json.NewEncoder(w).Encode(result)
 }
 
 func RouteChecksModify(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -122,8 +319,16 @@ func RouteChecksModify(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	check := &Check{}
-	err = db.View(func(tx *bolt.Tx) error {
-		data := tx.Bucket(UrlsBucket).Get(KeyFor(id))
+	var oldSchedule, oldTimeZone string
+	var verr *ValidationError
+	updated := false
+
+	// Apply the changes to the check as it's stored now, in the same
+	// transaction that saves it, so that a run finishing or the check being
+	// paused at the same time isn't overwritten.
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UrlsBucket)
+		data := b.Get(KeyFor(id))
 		if data == nil {
 			return fmt.Errorf("no such check: %d", id)
 		}
@@ -134,51 +339,222 @@ func RouteChecksModify(c web.C, w http.ResponseWriter, r *http.Request) {
 			}).Error("error unmarshaling json")
 			return err
 		}
-
 		check.ID = id
-		return nil
+
+		old := *check
+		oldSchedule = check.Schedule
+		oldTimeZone = check.TimeZone
+		if updated, verr = check.applyChanges(bodyJson); verr != nil || !updated {
+			return nil
+		}
+
+		if verr = check.restoreSecrets(&old); verr != nil {
+			return nil
+		}
+		if verr = check.Validate(); verr != nil {
+			return nil
+		}
+		check.SetDefaults()
+
+		data, err := json.Marshal(check)
+		if err != nil {
+			return err
+		}
+		return b.Put(KeyFor(id), data)
 	})
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if verr != nil {
+		WriteValidationError(w, verr)
+		return
+	}
+	if !updated {
+		// Only log the keys, since the values may include credentials.
+		var keys []string
+		for k := range bodyJson {
+			keys = append(keys, k)
+		}
+		log.WithFields(logrus.Fields{
+			"keys": keys,
+		}).Warn("no modifications given in PATCH request")
+		return
+	}
+
+	// If the schedule or its time zone changed, replace the existing job so
+	// the new schedule takes effect immediately.
+	if check.Schedule != oldSchedule || check.TimeZone != oldTimeZone {
+		// The schedule has already been validated, so this can't fail.
+		sched := c.Env["scheduler"].(*Scheduler)
+		ScheduleCheck(sched, c.Env["queue"].(*Queue), check)
+	}
+
+	// TODO: http status
+	json.NewEncoder(w).Encode(check.Redacted())
+}
 
-	// Update each of the fields in the check
+// Applies the fields given in a PATCH request body to the check.  Returns
+// false if none were given.
+func (c *Check) applyChanges(body map[string]interface{}) (bool, *ValidationError) {
 	updated := false
-	if v, ok := bodyJson["url"].(string); ok {
-		check.URL = v
+	if v, ok := body["type"].(string); ok {
+		c.Type = v
 		updated = true
 	}
-	if v, ok := bodyJson["selector"].(string); ok {
-		check.Selector = v
+	if v, ok := body["url"].(string); ok {
+		c.URL = v
 		updated = true
 	}
-	if v, ok := bodyJson["schedule"].(string); ok {
-		check.Schedule = v
+	if v, ok := body["mode"].(string); ok {
+		c.Mode = v
 		updated = true
 	}
-	if v, ok := bodyJson["seen"].(bool); ok {
-		check.SeenChange = v
+	if v, ok := body["selector"].(string); ok {
+		c.Selector = v
 		updated = true
 	}
+	if v, ok := body["regex"].(string); ok {
+		c.Regex = v
+		updated = true
+	}
+	if v, ok := body["value"].(string); ok {
+		c.Value = v
+		updated = true
+	}
+	if v, ok := body["attribute"].(string); ok {
+		c.Attribute = v
+		updated = true
+	}
+	if v, ok := body["schedule"].(string); ok {
+		c.Schedule = v
+		updated = true
+	}
+	if v, ok := body["time_zone"].(string); ok {
+		c.TimeZone = v
+		updated = true
+	}
+	if v, ok := body["seen"].(bool); ok {
+		c.SeenChange = v
+		updated = true
+	}
+	if v, ok := body["failure_threshold"].(float64); ok {
+		c.FailureThreshold = int(v)
+		updated = true
+	}
+	if v, ok := body["normalize"]; ok {
+		var normalize NormalizeOptions
+		if err := decodeField(v, &normalize); err != nil {
+			return false, &ValidationError{"normalize", "bad normalize parameter"}
+		}
 
-	if !updated {
-		log.WithFields(logrus.Fields{
-			"body": bodyJson,
-		}).Warn("no modifications given in PATCH request")
+		c.Normalize = normalize
+		updated = true
+	}
+	if v, ok := body["numeric"]; ok {
+		var numeric NumericOptions
+		if err := decodeField(v, &numeric); err != nil {
+			return false, &ValidationError{"numeric", "bad numeric parameter"}
+		}
+
+		c.Numeric = numeric
+		updated = true
+	}
+	if v, ok := body["keywords"]; ok {
+		var keywords []KeywordCondition
+		if err := decodeField(v, &keywords); err != nil {
+			return false, &ValidationError{"keywords", "bad keywords parameter"}
+		}
+
+		keepKeywordStates(keywords, c.Keywords)
+		c.Keywords = keywords
+		updated = true
+	}
+	if v, ok := body["min_change"]; ok {
+		var minChange ChangeThreshold
+		if err := decodeField(v, &minChange); err != nil {
+			return false, &ValidationError{"min_change", "bad min_change parameter"}
+		}
+
+		c.MinChange = minChange
+		updated = true
+	}
+	if v, ok := body["rules"]; ok {
+		var rules []Rule
+		if err := decodeField(v, &rules); err != nil {
+			return false, &ValidationError{"rules", "bad rules parameter"}
+		}
+
+		old := c.Rules
+		c.Rules = rules
+		c.keepRuleHashes(old)
+		updated = true
+	}
+	if v, ok := body["fetch"]; ok {
+		var fetch FetchOptions
+		if err := decodeField(v, &fetch); err != nil {
+			return false, &ValidationError{"fetch", "bad fetch parameter"}
+		}
+
+		c.Fetch = fetch
+		updated = true
+	}
+	if v, ok := body["retry"]; ok {
+		var retry RetryPolicy
+		if err := decodeField(v, &retry); err != nil {
+			return false, &ValidationError{"retry", "bad retry parameter"}
+		}
+
+		c.Retry = retry
+		updated = true
+	}
+	if v, ok := body["uptime"]; ok {
+		var uptime UptimeOptions
+		if err := decodeField(v, &uptime); err != nil {
+			return false, &ValidationError{"uptime", "bad uptime parameter"}
+		}
+
+		c.Uptime = uptime
+		updated = true
+	}
+	if v, ok := body["notifiers"]; ok {
+		var notifiers []NotifierConfig
+		if err := decodeField(v, &notifiers); err != nil {
+			return false, &ValidationError{"notifiers", "bad notifiers parameter"}
+		}
+
+		c.Notifiers = notifiers
+		updated = true
+	}
+
+	return updated, nil
+}
+
+func RouteChecksUpdateOne(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		data, err := json.Marshal(check)
-		if err != nil {
-			return err
+	check := &Check{}
+	err = db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(UrlsBucket).Get(KeyFor(id))
+		if data == nil {
+			return fmt.Errorf("no such check: %d", id)
 		}
 
-		if err = tx.Bucket(UrlsBucket).Put(KeyFor(check.ID), data); err != nil {
+		if err := json.Unmarshal(data, check); err != nil {
+			log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("error unmarshaling json")
 			return err
 		}
+
+		check.ID = id
 		return nil
 	})
 
@@ -187,11 +563,57 @@ func RouteChecksModify(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	queue := c.Env["queue"].(*Queue)
+	queue.Run(id, func() { queueRetry(queue, check.Update(db)) })
+
 	// TODO: http status
-	json.NewEncoder(w).Encode(check)
+	json.NewEncoder(w).Encode(check.Redacted())
 }
 
-func RouteChecksUpdateOne(c web.C, w http.ResponseWriter, r *http.Request) {
+// Stops scheduled runs of a check until it's resumed.
+func RouteChecksPause(c web.C, w http.ResponseWriter, r *http.Request) {
+	setCheckState(c, w, func(check *Check) {
+		check.Paused = true
+	})
+}
+
+// Restarts scheduled runs of a paused or snoozed check.
+func RouteChecksResume(c web.C, w http.ResponseWriter, r *http.Request) {
+	setCheckState(c, w, func(check *Check) {
+		check.Paused = false
+		check.SnoozedUntil = nil
+	})
+}
+
+// Stops scheduled runs of a check until the time given by the until
+// parameter, which is either an RFC 3339 time or a duration from now, such
+// as "2h".
+func RouteChecksSnooze(c web.C, w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	param := r.URL.Query().Get("until")
+
+	var until time.Time
+	if d, err := time.ParseDuration(param); err == nil {
+		until = now.Add(d)
+	} else if t, err := time.Parse(time.RFC3339, param); err == nil {
+		until = t
+	} else {
+		WriteValidationError(w, &ValidationError{"until", "until must be an RFC 3339 time or a duration"})
+		return
+	}
+	if !until.After(now) {
+		WriteValidationError(w, &ValidationError{"until", "until must be in the future"})
+		return
+	}
+
+	setCheckState(c, w, func(check *Check) {
+		check.SnoozedUntil = &until
+	})
+}
+
+// Loads the check named in the URL, applies the given change to it and
+// saves it, then writes the updated check.
+func setCheckState(c web.C, w http.ResponseWriter, change func(check *Check)) {
 	db := c.Env["db"].(*bolt.DB)
 
 	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
@@ -201,8 +623,9 @@ func RouteChecksUpdateOne(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	check := &Check{}
-	err = db.View(func(tx *bolt.Tx) error {
-		data := tx.Bucket(UrlsBucket).Get(KeyFor(id))
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UrlsBucket)
+		data := b.Get(KeyFor(id))
 		if data == nil {
 			return fmt.Errorf("no such check: %d", id)
 		}
@@ -213,20 +636,30 @@ func RouteChecksUpdateOne(c web.C, w http.ResponseWriter, r *http.Request) {
 			}).Error("error unmarshaling json")
 			return err
 		}
-
 		check.ID = id
-		return nil
+		change(check)
+
+		// A suspended check gives up any retry it has pending.
+		if check.Suspended(time.Now()) {
+			check.RetryAttempt = 0
+		}
+
+		data, err := json.Marshal(check)
+		if err != nil {
+			return err
+		}
+		return b.Put(KeyFor(id), data)
 	})
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if check.Suspended(time.Now()) {
+		c.Env["queue"].(*Queue).Remove(id)
+	}
 
-	check.Update(db)
-
-	// TODO: http status
-	json.NewEncoder(w).Encode(check)
+	json.NewEncoder(w).Encode(check.Redacted())
 }
 
 func RouteChecksDelete(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -239,13 +672,30 @@ func RouteChecksDelete(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(UrlsBucket).Delete(KeyFor(id))
+		if err := tx.Bucket(UrlsBucket).Delete(KeyFor(id)); err != nil {
+			return err
+		}
+		return DeleteCheckHistory(tx, id)
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	sched := c.Env["scheduler"].(*Scheduler)
+	sched.Remove(id)
+	c.Env["queue"].(*Queue).Remove(id)
+
 	w.Header().Del("Content-Type")
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// Converts a value decoded from a generic JSON body into the given structure,
+// for fields of a PATCH request that aren't simple scalars.
+func decodeField(v interface{}, output interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, output)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+func RouteDeliveriesGetAll(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deliveries := []*Delivery{}
+	err = GetDeliveries(db, id, &deliveries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(deliveries)
+}
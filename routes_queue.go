@@ -0,0 +1,14 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/zenazn/goji/web"
+)
+
+// Reports the checks waiting in the queue and those currently running.
+func RouteQueueGet(c web.C, w http.ResponseWriter, r *http.Request) {
+	queue := c.Env["queue"].(*Queue)
+	json.NewEncoder(w).Encode(queue.Status())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+// The number of runs returned per page when no limit is given.
+const defaultRunsLimit = 50
+
+// Returns the runs for a check, newest first.  Results are paginated with
+// the "offset" and "limit" query parameters, and the total number of runs is
+// returned in the X-Total-Count header.
+func RouteRunsGetAll(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	offset, limit, err := parsePagination(r, defaultRunsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	runs, total, err := GetRunsPage(db, id, offset, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	json.NewEncoder(w).Encode(runs)
+}
+
+// Returns the uptime of a check over the last 24 hours, 7 days and 30 days.
+func RouteUptimeGetOne(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	uptime, err := GetUptime(db, id, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(uptime)
+}
+
+// Parses the "offset" and "limit" query parameters, using the given default
+// limit if none is specified.
+func parsePagination(r *http.Request, defaultLimit int) (offset, limit int, err error) {
+	limit = defaultLimit
+
+	if v := r.URL.Query().Get("offset"); len(v) > 0 {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset: %s", v)
+		}
+	}
+	if v := r.URL.Query().Get("limit"); len(v) > 0 {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit: %s", v)
+		}
+	}
+	return offset, limit, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+// The window of upcoming runs returned when no hours parameter is given, and
+// the largest window allowed.
+const (
+	defaultScheduleHours = 24
+	maxScheduleHours     = 24 * 7
+)
+
+// The most runs listed for a single check, so that a check that runs every
+// few seconds doesn't swamp the listing.
+const maxScheduleRunsPerCheck = 500
+
+// A ScheduledRun is a single upcoming run of a check.
+type ScheduledRun struct {
+	CheckID uint64    `json:"check_id"`
+	URL     string    `json:"url"`
+	Time    time.Time `json:"time"`
+}
+
+type scheduledRunsByTime []*ScheduledRun
+
+func (s scheduledRunsByTime) Len() int      { return len(s) }
+func (s scheduledRunsByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s scheduledRunsByTime) Less(i, j int) bool {
+	if s[i].Time.Equal(s[j].Time) {
+		return s[i].CheckID < s[j].CheckID
+	}
+	return s[i].Time.Before(s[j].Time)
+}
+
+// Lists the scheduled runs of every check over the next "hours" hours, in
+// time order.  Runs that will be skipped because their check is paused or
+// snoozed aren't listed.  If any check had more than
+// maxScheduleRunsPerCheck runs in the window, the rest are left out and
+// "truncated" is set.
+func RouteScheduleGet(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+	sched := c.Env["scheduler"].(*Scheduler)
+
+	hours := defaultScheduleHours
+	if v := r.URL.Query().Get("hours"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxScheduleHours {
+			WriteValidationError(w, &ValidationError{"hours", "hours must be between 1 and " + strconv.Itoa(maxScheduleHours)})
+			return
+		}
+		hours = n
+	}
+
+	checks := []*Check{}
+	if err := GetAllChecks(db, &checks); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	until := now.Add(time.Duration(hours) * time.Hour)
+
+	runs := []*ScheduledRun{}
+	truncated := false
+	for _, check := range checks {
+		if check.Paused {
+			continue
+		}
+
+		// Runs during a snooze are skipped, so start after it.
+		from := now
+		if check.SnoozedUntil != nil && check.SnoozedUntil.After(now) {
+			from = check.SnoozedUntil.Add(-time.Nanosecond)
+		}
+
+		times := sched.Upcoming(check.ID, from, until, maxScheduleRunsPerCheck+1)
+		if len(times) > maxScheduleRunsPerCheck {
+			times = times[:maxScheduleRunsPerCheck]
+			truncated = true
+		}
+		for _, t := range times {
+			runs = append(runs, &ScheduledRun{
+				CheckID: check.ID,
+				URL:     check.URL,
+				Time:    t,
+			})
+		}
+	}
+	sort.Sort(scheduledRunsByTime(runs))
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":      now,
+		"until":     until,
+		"runs":      runs,
+		"truncated": truncated,
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+// Lists a check's snapshots.  The "field" query parameter limits the list to
+// the snapshots of a single extraction rule.
+func RouteSnapshotsGetAll(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	snapshots := []*Snapshot{}
+	err = GetSnapshots(db, id, &snapshots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if field, ok := r.URL.Query()["field"]; ok {
+		filtered := []*Snapshot{}
+		for _, snap := range snapshots {
+			if snap.Field == field[0] {
+				filtered = append(filtered, snap)
+			}
+		}
+		snapshots = filtered
+	}
+
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+func RouteSnapshotsGetOne(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sid, err := strconv.ParseUint(c.URLParams["sid"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	snap, err := GetSnapshot(db, id, sid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(snap)
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/zenazn/goji/web"
@@ -18,5 +20,24 @@ func RouteStatsGetAll(c web.C, w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
+	// Uptime for each check, keyed by check ID.
+	checks := []*Check{}
+	if err := GetAllChecks(db, &checks); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	uptime := map[string]interface{}{}
+	for _, check := range checks {
+		u, err := GetUptime(db, check.ID, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		uptime[strconv.FormatUint(check.ID, 10)] = u
+	}
+	context["uptime"] = uptime
+
 	json.NewEncoder(w).Encode(context)
 }
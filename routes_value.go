@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+	"github.com/zenazn/goji/web"
+)
+
+// Returns the time series of values recorded by a numeric check, oldest
+// first.  The "field" query parameter limits the list to the values of a
+// single extraction rule.
+func RouteValuesGetAll(c web.C, w http.ResponseWriter, r *http.Request) {
+	db := c.Env["db"].(*bolt.DB)
+
+	id, err := strconv.ParseUint(c.URLParams["id"], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values := []*NumericValue{}
+	err = GetValues(db, id, &values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if field, ok := r.URL.Query()["field"]; ok {
+		filtered := []*NumericValue{}
+		for _, value := range values {
+			if value.Field == field[0] {
+				filtered = append(filtered, value)
+			}
+		}
+		values = filtered
+	}
+
+	json.NewEncoder(w).Encode(values)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// A Rule is one of several named pieces of content extracted from a single
+// fetch of a check's page.  Each rule is hashed separately and has its own
+// snapshots and changes, which are tagged with the rule's name.
+type Rule struct {
+	Name      string             `json:"name"`
+	Mode      string             `json:"mode"`
+	Selector  string             `json:"selector"`
+	Regex     string             `json:"regex"`
+	Value     string             `json:"value"`
+	Attribute string             `json:"attribute"`
+	Normalize NormalizeOptions   `json:"normalize"`
+	Numeric   NumericOptions     `json:"numeric"`
+	Keywords  []KeywordCondition `json:"keywords,omitempty"`
+	LastHash  string             `json:"last_hash"`
+}
+
+// Returns a copy of the check that extracts content as the given rule does.
+func (c *Check) ruleCheck(rule *Rule) *Check {
+	rc := *c
+	rc.Mode = rule.Mode
+	rc.Selector = rule.Selector
+	rc.Regex = rule.Regex
+	rc.Value = rule.Value
+	rc.Attribute = rule.Attribute
+	rc.Normalize = rule.Normalize
+	rc.Numeric = rule.Numeric
+	rc.Keywords = rule.Keywords
+	rc.Rules = nil
+	return &rc
+}
+
+// Returns the rule with the given name, or nil if there isn't one.
+func (c *Check) rule(name string) *Rule {
+	for i := range c.Rules {
+		if c.Rules[i].Name == name {
+			return &c.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Copies the stored hashes and keyword states of the old rules into the new
+// rules with the same name, so that editing a check's rules doesn't make
+// unchanged rules look changed.
+func (c *Check) keepRuleHashes(old []Rule) {
+	for i := range c.Rules {
+		for _, o := range old {
+			if o.Name == c.Rules[i].Name {
+				c.Rules[i].LastHash = o.LastHash
+				keepKeywordStates(c.Rules[i].Keywords, o.Keywords)
+			}
+		}
+	}
+}
+
+// Validates each of the check's rules.  Rule names must be unique.
+func (c *Check) validateRules() *ValidationError {
+	if len(c.Rules) == 0 {
+		return nil
+	}
+	if c.Type == CheckFeed || c.Type == CheckUptime {
+		return &ValidationError{"rules", c.Type + " checks can't have extraction rules"}
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		field := fmt.Sprintf("rules[%d]", i)
+
+		if len(rule.Name) == 0 {
+			return &ValidationError{field + ".name", "missing Name parameter"}
+		}
+		if names[rule.Name] {
+			return &ValidationError{field + ".name", "duplicate rule name: " + rule.Name}
+		}
+		names[rule.Name] = true
+
+		if err := c.ruleCheck(rule).validateExtraction(); err != nil {
+			return &ValidationError{field + "." + err.Field, err.Message}
+		}
+	}
+	return nil
+}
+
+// Extracts and records the content of each of the check's rules.  A rule
+// that fails marks the run as failed, but doesn't stop the other rules from
+// being recorded.  The check's own LastHash becomes a hash of the rules'
+// hashes, so that it changes whenever any rule does.
+func (c *Check) updateRules(db *bolt.DB, run *Run, data []byte, statusCode int) {
+	var hashes []string
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+
+		ext, err := c.ruleCheck(rule).Extract(data)
+		if ext != nil {
+			run.Matched += ext.Matched
+		}
+		if err != nil {
+			run.Fail(err.(*ExtractError).Class, fmt.Errorf("%s: %s", rule.Name, err))
+			log.WithFields(logrus.Fields{
+				"id":       c.ID,
+				"rule":     rule.Name,
+				"mode":     rule.Mode,
+				"selector": rule.Selector,
+				"err":      err,
+			}).Error("error in check: extraction failed")
+		} else {
+			c.recordContent(db, run, rule.Name, ext, &rule.LastHash, statusCode)
+		}
+
+		hashes = append(hashes, rule.LastHash)
+	}
+
+	c.LastHash = HashText(strings.Join(hashes, "\n"))
+}
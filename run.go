@@ -0,0 +1,346 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// Classes of error that a run can fail with.
+const (
+	ErrorTimeout    = "timeout"
+	ErrorDNS        = "dns"
+	ErrorConnection = "connection"
+	ErrorTLS        = "tls"
+	ErrorFetch      = "fetch"
+	ErrorParse      = "parse"
+	ErrorSelector   = "selector"
+)
+
+// A Run records the outcome of a single execution of a check.
+type Run struct {
+	ID         uint64    `json:"id"`
+	CheckID    uint64    `json:"check_id"`
+	Start      time.Time `json:"start"`
+	DurationMs int64     `json:"duration_ms"`
+
+	// The time taken to receive the response headers.
+	ResponseTimeMs int64 `json:"response_time_ms"`
+
+	StatusCode int    `json:"status_code"`
+	Bytes      int64  `json:"bytes"`
+	Encoding   string `json:"encoding,omitempty"`
+	Matched    int    `json:"matched"`
+	ErrorClass string `json:"error_class,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Changed    bool   `json:"changed"`
+	ChangeID   uint64 `json:"change_id,omitempty"`
+
+	// For checks with a retry policy, which attempt this was, counting
+	// from one, and when the next attempt is due if the run is to be
+	// retried.
+	Attempt int        `json:"attempt,omitempty"`
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+}
+
+// Records that the run failed with the given error.
+func (r *Run) Fail(class string, err error) {
+	r.ErrorClass = class
+	r.Error = err.Error()
+}
+
+// Returns true if the run completed without error.
+func (r *Run) Succeeded() bool {
+	return len(r.ErrorClass) == 0
+}
+
+// Determines the error class for an error returned while fetching a URL.
+func ClassifyFetchError(err error) string {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return ErrorTimeout
+	}
+
+	switch e := err.(type) {
+	case *net.DNSError:
+		return ErrorDNS
+	case *net.OpError:
+		if _, ok := e.Err.(*net.DNSError); ok {
+			return ErrorDNS
+		}
+		return ErrorConnection
+	case tls.RecordHeaderError:
+		return ErrorTLS
+	}
+
+	// Certificate errors come in many types, depending on where in the
+	// handshake they happened.
+	if strings.Contains(err.Error(), "x509:") || strings.Contains(err.Error(), "tls:") {
+		return ErrorTLS
+	}
+	return ErrorFetch
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Sorts runs by ID, which is also the order they started in.
+type runsByID []*Run
+
+func (s runsByID) Len() int           { return len(s) }
+func (s runsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s runsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// Saves the given run, assigning it a new ID.
+func SaveRun(db *bolt.DB, run *Run) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(RunsBucket).CreateBucketIfNotExists(KeyFor(run.CheckID))
+		if err != nil {
+			return err
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		run.ID = uint64(seq)
+
+		data, err := json.Marshal(run)
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put(KeyFor(run.ID), data); err != nil {
+			return err
+		}
+		if err := setLatest(tx, run.CheckID, RunsBucket, "", run.ID); err != nil {
+			return err
+		}
+
+		// Count the runs saved before the count was kept, once.
+		return addCount(tx, run.CheckID, RunsBucket, 1, func() int {
+			n := 0
+			b.ForEach(func(k, v []byte) error {
+				n++
+				return nil
+			})
+			return n
+		})
+	})
+}
+
+// Loads the most recent run of the given check, or nil if it has never run.
+func GetLatestRun(db *bolt.DB, checkID uint64) (*Run, error) {
+	var run *Run
+	err := db.View(func(tx *bolt.Tx) error {
+		id, ok := getLatest(tx, checkID, RunsBucket, "")
+		if !ok {
+			return nil
+		}
+
+		data := tx.Bucket(RunsBucket).Bucket(KeyFor(checkID)).Get(KeyFor(id))
+		if data == nil {
+			return nil
+		}
+
+		run = &Run{}
+		if err := json.Unmarshal(data, run); err != nil {
+			return err
+		}
+		run.ID = id
+		return nil
+	})
+	if err != nil || run != nil {
+		return run, err
+	}
+
+	// Not indexed, so load the check's whole history.
+	runs := []*Run{}
+	if err := GetRuns(db, checkID, &runs); err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, nil
+	}
+	return runs[len(runs)-1], nil
+}
+
+// Loads a page of the given check's runs, newest first, skipping the first
+// offset runs.  Also returns the total number of runs, which is kept
+// alongside the index of the latest run.  Run IDs are sequential, so the page
+// is found by counting down from the latest run rather than loading the
+// check's whole history.
+func GetRunsPage(db *bolt.DB, checkID uint64, offset, limit int) ([]*Run, int, error) {
+	runs := []*Run{}
+	total := 0
+	indexed := false
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RunsBucket).Bucket(KeyFor(checkID))
+		if b == nil {
+			indexed = true
+			return nil
+		}
+
+		latest, ok := getLatest(tx, checkID, RunsBucket, "")
+		if !ok {
+			return nil
+		}
+		if total, ok = getCount(tx, checkID, RunsBucket); !ok {
+			return nil
+		}
+		indexed = true
+
+		// Old runs are pruned, so stop once every remaining run has been
+		// seen.
+		seen := 0
+		for id := latest; id > 0 && seen < total && len(runs) < limit; id-- {
+			data := b.Get(KeyFor(id))
+			if data == nil {
+				continue
+			}
+			seen++
+			if seen <= offset {
+				continue
+			}
+
+			run := &Run{}
+			if err := json.Unmarshal(data, run); err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err,
+				}).Error("error unmarshaling json")
+				continue
+			}
+			run.ID = id
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	if err != nil || indexed {
+		return runs, total, err
+	}
+
+	// Not indexed, so load the check's whole history.
+	all := []*Run{}
+	if err := GetRuns(db, checkID, &all); err != nil {
+		return nil, 0, err
+	}
+	for i := len(all) - 1 - offset; i >= 0 && len(runs) < limit; i-- {
+		runs = append(runs, all[i])
+	}
+	return runs, len(all), nil
+}
+
+// Loads the given check's runs that started at or after since, oldest first.
+// Like GetRunsPage, this counts down from the latest run, stopping at the
+// first run that started before since.
+func GetRunsSince(db *bolt.DB, checkID uint64, since time.Time) ([]*Run, error) {
+	runs := []*Run{}
+	indexed := false
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RunsBucket).Bucket(KeyFor(checkID))
+		if b == nil {
+			indexed = true
+			return nil
+		}
+
+		latest, ok := getLatest(tx, checkID, RunsBucket, "")
+		if !ok {
+			return nil
+		}
+		total, ok := getCount(tx, checkID, RunsBucket)
+		if !ok {
+			return nil
+		}
+		indexed = true
+
+		seen := 0
+		for id := latest; id > 0 && seen < total; id-- {
+			data := b.Get(KeyFor(id))
+			if data == nil {
+				continue
+			}
+			seen++
+
+			run := &Run{}
+			if err := json.Unmarshal(data, run); err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err,
+				}).Error("error unmarshaling json")
+				continue
+			}
+			if run.Start.Before(since) {
+				break
+			}
+			run.ID = id
+			runs = append(runs, run)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !indexed {
+		// Not indexed, so load the check's whole history.
+		all := []*Run{}
+		if err := GetRuns(db, checkID, &all); err != nil {
+			return nil, err
+		}
+		for i := len(all) - 1; i >= 0 && !all[i].Start.Before(since); i-- {
+			runs = append(runs, all[i])
+		}
+	}
+
+	sort.Sort(runsByID(runs))
+	return runs, nil
+}
+
+// Loads all runs for the given check, oldest first.
+func GetRuns(db *bolt.DB, checkID uint64, output *[]*Run) error {
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RunsBucket).Bucket(KeyFor(checkID))
+		if b == nil {
+			return nil
+		}
+
+		b.ForEach(func(k, v []byte) error {
+			run := &Run{}
+			if err := json.Unmarshal(v, run); err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err,
+				}).Error("error unmarshaling json")
+				return nil
+			}
+
+			run.ID = binary.LittleEndian.Uint64(k)
+			*output = append(*output, run)
+			return nil
+		})
+		return nil
+	})
+
+	sort.Sort(runsByID(*output))
+	return err
+}
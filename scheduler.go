@@ -0,0 +1,204 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Scheduler runs a single job per check ID on a cron schedule.  Unlike
+// cron.Cron, jobs can be replaced or removed after the scheduler has started,
+// so that edits to a check's schedule take effect immediately.
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    map[uint64]*scheduledJob
+	running bool
+}
+
+type scheduledJob struct {
+	spec     string
+	schedule cron.Schedule
+	loc      *time.Location
+	fn       func()
+	timer    *time.Timer
+	next     time.Time
+
+	// Incremented every time the job is armed or stopped, so that a timer
+	// that fires after being superseded can tell.
+	gen uint64
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		jobs: make(map[uint64]*scheduledJob),
+	}
+}
+
+// Set adds a job for the given ID, replacing any existing job.  The spec is
+// evaluated in the given time zone.  If the spec can't be parsed, an error is
+// returned and any existing job is left alone.
+func (s *Scheduler) Set(id uint64, spec string, loc *time.Location, fn func()) error {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.jobs[id]; ok {
+		old.stop()
+	}
+
+	job := &scheduledJob{
+		spec:     spec,
+		schedule: schedule,
+		loc:      loc,
+		fn:       fn,
+	}
+	s.jobs[id] = job
+	if s.running {
+		s.arm(id, job, time.Now())
+	}
+	return nil
+}
+
+// Remove stops and removes the job for the given ID, if there is one.
+func (s *Scheduler) Remove(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if job, ok := s.jobs[id]; ok {
+		job.stop()
+		delete(s.jobs, id)
+	}
+}
+
+// Next returns the time the job for the given ID will next run, in the job's
+// time zone.  It returns false if there's no such job, the scheduler isn't
+// running, or the schedule can never be satisfied.
+func (s *Scheduler) Next(id uint64) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok || job.next.IsZero() {
+		return time.Time{}, false
+	}
+	return job.next, true
+}
+
+// Upcoming returns up to max of the times the job for the given ID will run
+// after from and no later than until, in order.  A zero until means no limit.
+func (s *Scheduler) Upcoming(id uint64, from, until time.Time, max int) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok || job.next.IsZero() {
+		return nil
+	}
+
+	// Start from the armed time if we can, since constant-delay schedules
+	// count from when the job last ran rather than from an arbitrary time.
+	t := job.next
+	if !from.Before(t) {
+		t = nextAfter(job.schedule, from.In(job.loc))
+	}
+
+	var times []time.Time
+	for !t.IsZero() && len(times) < max && (until.IsZero() || !t.After(until)) {
+		times = append(times, t)
+		t = nextAfter(job.schedule, t)
+	}
+	return times
+}
+
+// The furthest nextAfter looks past a time the schedule wrongly returns.
+// Clocks never go back by more than an hour.
+const maxScheduleRetry = time.Hour
+
+// Returns the schedule's next activation strictly after t, or the zero time
+// if there isn't one.  cron's Next can return a time that isn't after t when
+// a wall-clock time repeats, such as at the end of daylight saving time, so
+// in that case the search is retried from a second later.
+func nextAfter(schedule cron.Schedule, t time.Time) time.Time {
+	for from := t; !from.After(t.Add(maxScheduleRetry)); from = from.Add(time.Second) {
+		next := schedule.Next(from)
+		if next.IsZero() || next.After(t) {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// Start begins running jobs.  Jobs added before Start is called will first
+// run at their next scheduled time after it.
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return
+	}
+	s.running = true
+
+	now := time.Now()
+	for id, job := range s.jobs {
+		s.arm(id, job, now)
+	}
+}
+
+// Stop stops running jobs.  Jobs that are already running are not
+// interrupted.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.running = false
+	for _, job := range s.jobs {
+		job.stop()
+	}
+}
+
+// Arms the timer for the job's next activation after the given time.  Must
+// be called with the lock held.
+func (s *Scheduler) arm(id uint64, job *scheduledJob, now time.Time) {
+	job.gen++
+	job.next = nextAfter(job.schedule, now.In(job.loc))
+	if job.next.IsZero() {
+		// The schedule can never be satisfied.
+		return
+	}
+
+	gen := job.gen
+	job.timer = time.AfterFunc(job.next.Sub(now), func() {
+		s.fire(id, job, gen)
+	})
+}
+
+func (s *Scheduler) fire(id uint64, job *scheduledJob, gen uint64) {
+	s.mu.Lock()
+
+	// The job may have been replaced, removed or re-armed while the timer
+	// was pending.
+	if s.jobs[id] != job || job.gen != gen || !s.running {
+		s.mu.Unlock()
+		return
+	}
+
+	s.arm(id, job, time.Now())
+	s.mu.Unlock()
+
+	go job.fn()
+}
+
+func (j *scheduledJob) stop() {
+	j.gen++
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+	j.next = time.Time{}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+func TestNextAfter(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+
+	// 01:30 happens twice on the day daylight saving time ends, and not at
+	// all on the day it starts.
+	edt := time.Date(2026, 11, 1, 1, 30, 0, 0, loc)
+	est := edt.Add(time.Hour)
+	tests := []struct {
+		spec string
+		t    time.Time
+		want time.Time
+	}{
+		{"0 30 1 * * *", edt.Add(-time.Minute), edt},
+		{"0 30 1 * * *", edt, est},
+		{"0 30 1 * * *", est, time.Date(2026, 11, 2, 1, 30, 0, 0, loc)},
+		{"0 30 1 * * *", est.Add(time.Millisecond), time.Date(2026, 11, 2, 1, 30, 0, 0, loc)},
+		{"0 0 * * * *", est, est.Add(30 * time.Minute)},
+		{"0 30 2 * * *", time.Date(2026, 3, 8, 1, 0, 0, 0, loc), time.Date(2026, 3, 9, 2, 30, 0, 0, loc)},
+		{"@every 90s", est, est.Add(90 * time.Second)},
+		{"0 0 0 30 2 *", est, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		schedule, err := cron.Parse(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := nextAfter(schedule, tt.t)
+		if !got.Equal(tt.want) {
+			t.Errorf("nextAfter(%q, %v) = %v, want %v", tt.spec, tt.t, got, tt.want)
+		}
+	}
+}
+
+// Upcoming runs must be strictly increasing, even across a repeated hour.
+func TestSchedulerUpcomingDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data not available")
+	}
+
+	s := NewScheduler()
+	s.Set(1, "0 30 1 * * *", loc, func() {})
+	s.Start()
+	defer s.Stop()
+
+	from := time.Date(2026, 10, 31, 12, 0, 0, 0, loc)
+	times := s.Upcoming(1, from, from.Add(72*time.Hour), 10)
+	if len(times) != 4 {
+		t.Errorf("Upcoming returned %d times, want 4: %v", len(times), times)
+	}
+	for i := 1; i < len(times); i++ {
+		if !times[i].After(times[i-1]) {
+			t.Errorf("Upcoming returned %v after %v", times[i], times[i-1])
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+// A Snapshot records the content of a check at the time a change was
+// detected.  Snapshots are stored in a per-check bucket nested under the
+// top-level snapshots bucket.
+type Snapshot struct {
+	ID         uint64    `json:"id"`
+	CheckID    uint64    `json:"check_id"`
+	Field      string    `json:"field,omitempty"`
+	Time       time.Time `json:"time"`
+	Hash       string    `json:"hash"`
+	Text       string    `json:"text"`
+	HTML       string    `json:"html"`
+	Values     []string  `json:"values,omitempty"`
+	StatusCode int       `json:"status_code"`
+}
+
+// Sorts snapshots by ID, which is also the order they were taken in.
+type snapshotsByID []*Snapshot
+
+func (s snapshotsByID) Len() int           { return len(s) }
+func (s snapshotsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s snapshotsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+
+// Saves the given snapshot, assigning it a new ID.
+func SaveSnapshot(db *bolt.DB, snap *Snapshot) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return saveSnapshot(tx, snap)
+	})
+}
+
+func saveSnapshot(tx *bolt.Tx, snap *Snapshot) error {
+	b, err := tx.Bucket(SnapshotsBucket).CreateBucketIfNotExists(KeyFor(snap.CheckID))
+	if err != nil {
+		return err
+	}
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	snap.ID = uint64(seq)
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	if err = b.Put(KeyFor(snap.ID), data); err != nil {
+		return err
+	}
+	return setLatest(tx, snap.CheckID, SnapshotsBucket, snap.Field, snap.ID)
+}
+
+// Loads all snapshots for the given check, oldest first.
+func GetSnapshots(db *bolt.DB, checkID uint64, output *[]*Snapshot) error {
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(SnapshotsBucket).Bucket(KeyFor(checkID))
+		if b == nil {
+			return nil
+		}
+
+		b.ForEach(func(k, v []byte) error {
+			snap := &Snapshot{}
+			if err := json.Unmarshal(v, snap); err != nil {
+				log.WithFields(logrus.Fields{
+					"err": err,
+				}).Error("error unmarshaling json")
+				return nil
+			}
+
+			snap.ID = binary.LittleEndian.Uint64(k)
+			*output = append(*output, snap)
+			return nil
+		})
+		return nil
+	})
+
+	// Keys are little-endian, so bolt's ordering isn't chronological.
+	sort.Sort(snapshotsByID(*output))
+	return err
+}
+
+// Loads a single snapshot for the given check.
+func GetSnapshot(db *bolt.DB, checkID, id uint64) (*Snapshot, error) {
+	snap := &Snapshot{}
+	err := db.View(func(tx *bolt.Tx) error {
+		var data []byte
+		if b := tx.Bucket(SnapshotsBucket).Bucket(KeyFor(checkID)); b != nil {
+			data = b.Get(KeyFor(id))
+		}
+		if data == nil {
+			return fmt.Errorf("no such snapshot: %d", id)
+		}
+
+		if err := json.Unmarshal(data, snap); err != nil {
+			return err
+		}
+
+		snap.ID = id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Loads the most recent snapshot of the given field for the given check, or
+// nil if there is none.  Checks without rules only have the empty field.
+func GetLatestSnapshot(db *bolt.DB, checkID uint64, field string) (*Snapshot, error) {
+	var snap *Snapshot
+	err := db.View(func(tx *bolt.Tx) error {
+		id, ok := getLatest(tx, checkID, SnapshotsBucket, field)
+		if !ok {
+			return nil
+		}
+
+		data := tx.Bucket(SnapshotsBucket).Bucket(KeyFor(checkID)).Get(KeyFor(id))
+		if data == nil {
+			return nil
+		}
+
+		snap = &Snapshot{}
+		if err := json.Unmarshal(data, snap); err != nil {
+			return err
+		}
+		snap.ID = id
+		return nil
+	})
+	if err != nil || snap != nil {
+		return snap, err
+	}
+
+	// Not indexed, so search the check's whole history.
+	snapshots := []*Snapshot{}
+	if err := GetSnapshots(db, checkID, &snapshots); err != nil {
+		return nil, err
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].Field == field {
+			return snapshots[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -19,6 +19,9 @@ var ItemRow = React.createClass({
             selector: React.PropTypes.string.isRequired,
             schedule: React.PropTypes.string.isRequired,
             seen:     React.PropTypes.bool.isRequired,
+            last_change_id: React.PropTypes.number,
+            health:         React.PropTypes.string,
+            last_error:     React.PropTypes.string,
         }),
     },
 
@@ -30,14 +33,29 @@ var ItemRow = React.createClass({
             label = <span className="label label-primary">Changed</span>;
         }
 
+        var health;
+        if( this.props.item.health === 'failing' ) {
+            health = <span className="label label-danger" title={this.props.item.last_error}>Failing</span>;
+        } else if( this.props.item.health === 'degraded' ) {
+            health = <span className="label label-warning" title={this.props.item.last_error}>Degraded</span>;
+        }
+
+        var diff = 'none';
+        if( this.props.item.last_change_id ) {
+            var diffUrl = '/api/checks/' + this.props.item.id +
+                          '/changes/' + this.props.item.last_change_id +
+                          '/diff?format=unified';
+            diff = <a href={diffUrl} target="_blank">View diff</a>;
+        }
+
         return (
             <tr>
-                <td>{label}</td>
+                <td>{label} {health}</td>
                 <td>{this.props.item.url}</td>
                 <td>{this.props.item.selector}</td>
                 <td>{this.props.item.schedule}</td>
                 <td>Last Successful Check</td>
-                <td>Hash</td>
+                <td>{diff}</td>
                 <td>
                     <ActionButton
                         type="btn-success"
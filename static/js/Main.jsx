@@ -36,7 +36,7 @@ var Main = React.createClass({
                             <th>Selector</th>
                             <th>Schedule</th>
                             <th>Last Successful Check</th>
-                            <th>Hash</th>
+                            <th>Last Change</th>
                             <th>Actions</th>
                         </tr>
                     </thead>
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The kinds of check.  Content checks (the default) watch for changes in
+// the selected content, and JSON checks in values selected from a JSON
+// response; feed checks watch an RSS or Atom feed for new entries; uptime
+// checks assert that the page is up.
+const (
+	CheckContent = "content"
+	CheckJSON    = "json"
+	CheckFeed    = "feed"
+	CheckUptime  = "uptime"
+)
+
+// Error classes for failed uptime assertions.
+const (
+	ErrorStatus       = "status"
+	ErrorResponseTime = "response_time"
+	ErrorContent      = "content"
+)
+
+// UptimeOptions holds the assertions made by an uptime check.
+type UptimeOptions struct {
+	// The acceptable status codes.  If empty, any 2xx status is accepted.
+	ExpectedStatus []int `json:"expected_status,omitempty"`
+
+	// The maximum acceptable time to receive a response, as a duration
+	// string such as "2s".  If empty, response time isn't checked.
+	MaxResponseTime string `json:"max_response_time,omitempty"`
+
+	// Substrings that must, or must not, appear in the response body.
+	RequiredText  []string `json:"required_text,omitempty"`
+	ForbiddenText []string `json:"forbidden_text,omitempty"`
+}
+
+func (o *UptimeOptions) Validate() *ValidationError {
+	for _, code := range o.ExpectedStatus {
+		if code < 100 || code > 599 {
+			return &ValidationError{"uptime.expected_status", fmt.Sprintf("invalid status code: %d", code)}
+		}
+	}
+	if len(o.MaxResponseTime) > 0 {
+		d, err := time.ParseDuration(o.MaxResponseTime)
+		if err != nil {
+			return &ValidationError{"uptime.max_response_time", err.Error()}
+		}
+		if d <= 0 {
+			return &ValidationError{"uptime.max_response_time", "max_response_time must be positive"}
+		}
+	}
+	return nil
+}
+
+func (o *UptimeOptions) statusOK(code int) bool {
+	if len(o.ExpectedStatus) == 0 {
+		return code >= 200 && code <= 299
+	}
+	for _, expected := range o.ExpectedStatus {
+		if code == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the response against the assertions, recording any failure on the
+// run.  The response body is read and closed.
+func (o *UptimeOptions) Assert(run *Run, resp *http.Response) {
+	defer resp.Body.Close()
+
+	if !o.statusOK(resp.StatusCode) {
+		run.Fail(ErrorStatus, fmt.Errorf("unexpected status code: %d", resp.StatusCode))
+		return
+	}
+
+	if len(o.MaxResponseTime) > 0 {
+		max, _ := time.ParseDuration(o.MaxResponseTime)
+		if elapsed := time.Duration(run.ResponseTimeMs) * time.Millisecond; elapsed > max {
+			run.Fail(ErrorResponseTime, fmt.Errorf("response took %s, more than %s", elapsed, max))
+			return
+		}
+	}
+
+	if len(o.RequiredText) == 0 && len(o.ForbiddenText) == 0 {
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		run.Fail(ErrorFetch, err)
+		return
+	}
+	body, run.Encoding = DecodeBody(body, resp.Header.Get("Content-Type"))
+
+	for _, s := range o.RequiredText {
+		if !bytes.Contains(body, []byte(s)) {
+			run.Fail(ErrorContent, fmt.Errorf("required text not found: %q", s))
+			return
+		}
+	}
+	for _, s := range o.ForbiddenText {
+		if bytes.Contains(body, []byte(s)) {
+			run.Fail(ErrorContent, fmt.Errorf("forbidden text found: %q", s))
+			return
+		}
+	}
+}
+
+// UptimeWindow summarizes the runs of a check over a period of time.  Uptime
+// is a percentage, and is nil if there were no runs in the window.
+type UptimeWindow struct {
+	Runs          int      `json:"runs"`
+	Failures      int      `json:"failures"`
+	Uptime        *float64 `json:"uptime"`
+	AvgResponseMs *int64   `json:"avg_response_ms"`
+}
+
+// The windows that uptime is reported over.
+var uptimeWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// Loads the given check's runs in the longest of the standard windows and
+// computes its uptime over each of them.
+func GetUptime(db *bolt.DB, checkID uint64, now time.Time) (map[string]*UptimeWindow, error) {
+	since := now
+	for _, window := range uptimeWindows {
+		if t := now.Add(-window.Duration); t.Before(since) {
+			since = t
+		}
+	}
+
+	runs, err := GetRunsSince(db, checkID, since)
+	if err != nil {
+		return nil, err
+	}
+	return ComputeUptime(runs, now), nil
+}
+
+// Computes uptime over each of the standard windows ending at the given time.
+func ComputeUptime(runs []*Run, now time.Time) map[string]*UptimeWindow {
+	ret := make(map[string]*UptimeWindow)
+
+	for _, window := range uptimeWindows {
+		since := now.Add(-window.Duration)
+		w := &UptimeWindow{}
+
+		var totalResponse int64
+		var responses int64
+		for _, run := range runs {
+			if run.Start.Before(since) {
+				continue
+			}
+
+			w.Runs++
+			if !run.Succeeded() {
+				w.Failures++
+			}
+			if run.StatusCode != 0 {
+				totalResponse += run.ResponseTimeMs
+				responses++
+			}
+		}
+
+		if w.Runs > 0 {
+			uptime := 100 * float64(w.Runs-w.Failures) / float64(w.Runs)
+			w.Uptime = &uptime
+		}
+		if responses > 0 {
+			avg := totalResponse / responses
+			w.AvgResponseMs = &avg
+		}
+
+		ret[window.Name] = w
+	}
+
+	return ret
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"code.google.com/p/cascadia"
+	"github.com/robfig/cron"
+)
+
+// A ValidationError describes a problem with a single field of a check.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// Writes the given error as a structured 400 response.
+func WriteValidationError(w http.ResponseWriter, err *ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(err)
+}
+
+func ValidateURL(u string) *ValidationError {
+	if len(u) == 0 {
+		return &ValidationError{"url", "missing URL parameter"}
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return &ValidationError{"url", err.Error()}
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return &ValidationError{"url", "URL scheme must be http or https"}
+	}
+	if len(parsed.Host) == 0 {
+		return &ValidationError{"url", "URL must include a host"}
+	}
+	return nil
+}
+
+func ValidateType(t string) *ValidationError {
+	switch t {
+	case "", CheckContent, CheckJSON, CheckFeed, CheckUptime:
+		return nil
+	}
+	return &ValidationError{"type", "type must be one of 'content', 'json', 'feed' or 'uptime'"}
+}
+
+// Validates the extraction settings of a content check.  The selector is
+// required in CSS and XPath modes, and the regex in regex mode.
+func ValidateExtraction(mode, sel, regex string) *ValidationError {
+	switch mode {
+	case "", ModeCSS, ModeXPath, ModeRegex:
+	default:
+		return &ValidationError{"mode", "mode must be one of 'css', 'xpath' or 'regex'"}
+	}
+
+	if mode == ModeRegex {
+		if len(regex) == 0 {
+			return &ValidationError{"regex", "missing Regex parameter"}
+		}
+	} else if len(sel) == 0 {
+		return &ValidationError{"selector", "missing Selector parameter"}
+	}
+
+	if mode == ModeXPath {
+		if _, err := CompileXPath(sel); err != nil {
+			return &ValidationError{"selector", "invalid XPath expression: " + err.Error()}
+		}
+	} else if mode != ModeRegex {
+		if _, err := cascadia.Compile(sel); err != nil {
+			return &ValidationError{"selector", "invalid CSS selector: " + err.Error()}
+		}
+	}
+
+	if len(regex) > 0 {
+		if _, err := regexp.Compile(regex); err != nil {
+			return &ValidationError{"regex", "invalid regular expression: " + err.Error()}
+		}
+	}
+	return nil
+}
+
+// Validates what is extracted from each node matched by a content check.
+// Regex mode doesn't select nodes, so only extracts text.
+func ValidateValue(mode, value, attr string) *ValidationError {
+	switch value {
+	case "", ValueText:
+		return nil
+	case ValueInnerHTML, ValueOuterHTML, ValueAttribute:
+	default:
+		return &ValidationError{"value", "value must be one of 'text', 'inner_html', 'outer_html' or 'attribute'"}
+	}
+
+	if mode == ModeRegex {
+		return &ValidationError{"value", "regex mode can only extract text"}
+	}
+	if value == ValueAttribute && len(attr) == 0 {
+		return &ValidationError{"attribute", "missing Attribute parameter"}
+	}
+	return nil
+}
+
+func ValidateSchedule(spec string) *ValidationError {
+	if len(spec) == 0 {
+		return &ValidationError{"schedule", "missing Schedule parameter"}
+	}
+
+	if _, err := cron.Parse(spec); err != nil {
+		return &ValidationError{"schedule", "invalid cron schedule: " + err.Error()}
+	}
+	return nil
+}
+
+// Validates an IANA time zone name, such as "Europe/London".  An empty name
+// means the server's local zone.
+func ValidateTimeZone(name string) *ValidationError {
+	if len(name) == 0 {
+		return nil
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return &ValidationError{"time_zone", "unknown time zone: " + name}
+	}
+	return nil
+}
+
+func ValidateNotifiers(notifiers []NotifierConfig) *ValidationError {
+	for i, nc := range notifiers {
+		if _, err := nc.Notifier(); err != nil {
+			return &ValidationError{fmt.Sprintf("notifiers[%d]", i), err.Error()}
+		}
+	}
+	return nil
+}
+
+// Validates the settings that control how content is extracted from the
+// page, which depend on the type of check.
+func (c *Check) validateExtraction() *ValidationError {
+	switch c.Type {
+	case CheckJSON:
+		if _, err := CompileJSONPath(c.Selector); err != nil {
+			return &ValidationError{"selector", "invalid JSON path: " + err.Error()}
+		}
+		if c.Normalize.Enabled() {
+			return &ValidationError{"normalize", "JSON checks can't be normalised"}
+		}
+		if err := c.Numeric.Validate(); err != nil {
+			return err
+		}
+		if err := validateKeywords(c.Keywords); err != nil {
+			return err
+		}
+	case CheckFeed:
+		// Feed entries aren't parsed as numbers, but keyword conditions
+		// apply to the feed's text.
+		if c.Normalize.Enabled() {
+			return &ValidationError{"normalize", "feed checks can't be normalised"}
+		}
+		if c.Numeric.Enabled {
+			return &ValidationError{"numeric", "feed checks can't track a numeric value"}
+		}
+		if err := validateKeywords(c.Keywords); err != nil {
+			return err
+		}
+	case CheckUptime:
+		if c.Normalize.Enabled() {
+			return &ValidationError{"normalize", "uptime checks can't be normalised"}
+		}
+		if c.Numeric.Enabled {
+			return &ValidationError{"numeric", "uptime checks can't track a numeric value"}
+		}
+		if len(c.Keywords) > 0 {
+			return &ValidationError{"keywords", "uptime checks can't have keyword conditions"}
+		}
+	default:
+		if err := ValidateExtraction(c.Mode, c.Selector, c.Regex); err != nil {
+			return err
+		}
+		if err := ValidateValue(c.Mode, c.Value, c.Attribute); err != nil {
+			return err
+		}
+		if err := c.Normalize.Validate(); err != nil {
+			return err
+		}
+		// Exclusions remove nodes from the parsed page, so they can't
+		// apply to the raw body that regex mode matches against.
+		if c.Mode == ModeRegex && len(c.Normalize.Exclude) > 0 {
+			return &ValidationError{"normalize.exclude", "regex mode can't exclude nodes"}
+		}
+		if err := c.Numeric.Validate(); err != nil {
+			return err
+		}
+		if err := validateKeywords(c.Keywords); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validates every field of the check, returning the first problem found.
+func (c *Check) Validate() *ValidationError {
+	return c.validate(true)
+}
+
+func (c *Check) validate(requireSchedule bool) *ValidationError {
+	if err := ValidateURL(c.URL); err != nil {
+		return err
+	}
+	if err := ValidateType(c.Type); err != nil {
+		return err
+	}
+	if len(c.Rules) > 0 {
+		if err := c.validateRules(); err != nil {
+			return err
+		}
+	} else if err := c.validateExtraction(); err != nil {
+		return err
+	}
+	if requireSchedule || len(c.Schedule) > 0 {
+		if err := ValidateSchedule(c.Schedule); err != nil {
+			return err
+		}
+	}
+	if err := ValidateTimeZone(c.TimeZone); err != nil {
+		return err
+	}
+	if err := c.MinChange.Validate(); err != nil {
+		return err
+	}
+	if err := c.Uptime.Validate(); err != nil {
+		return err
+	}
+	if c.FailureThreshold < 0 {
+		return &ValidationError{"failure_threshold", "failure_threshold cannot be negative"}
+	}
+	if err := c.Fetch.Validate(); err != nil {
+		return err
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return err
+	}
+	if err := ValidateNotifiers(c.Notifiers); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,1070 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"code.google.com/p/go.net/html"
+)
+
+// This file implements the subset of XPath 1.0 that's useful for picking
+// content out of HTML documents: location paths with all of the common axes,
+// predicates, the comparison and boolean operators, unions, and the core
+// string and node-set functions.  Attributes selected with the attribute axis
+// are returned as nodes of type attributeNode, whose parent is the element
+// they belong to and whose single Attr entry holds the name and value.
+
+const attributeNode html.NodeType = 100
+
+// An XPath is a compiled XPath expression.
+type XPath struct {
+	expr xpathExpr
+}
+
+// CompileXPath parses the given expression.
+func CompileXPath(s string) (*XPath, error) {
+	toks, err := xpathTokenize(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &xpathParser{toks: toks}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected '%s' at end of expression", p.peek().val)
+	}
+
+	return &XPath{expr}, nil
+}
+
+// Select evaluates the expression against the given node, which must return
+// a node-set.  Nodes are returned in document order.
+func (x *XPath) Select(root *html.Node) ([]*html.Node, error) {
+	v := x.expr.eval(&xpathContext{node: root, pos: 1, size: 1})
+	nodes, ok := v.([]*html.Node)
+	if !ok {
+		return nil, fmt.Errorf("expression does not select nodes")
+	}
+	return nodes, nil
+}
+
+// Returns the XPath string-value of a node.
+func xpathStringValue(n *html.Node) string {
+	switch n.Type {
+	case attributeNode:
+		return n.Attr[0].Val
+	case html.TextNode, html.CommentNode:
+		return n.Data
+	}
+
+	var buf []string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf = append(buf, n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(buf, "")
+}
+
+// ------------------------------------------------------------------------
+// Tokenizer
+
+type xpathToken struct {
+	kind string // "op", "name", "string", "number"
+	val  string
+}
+
+func xpathTokenize(s string) ([]xpathToken, error) {
+	var toks []xpathToken
+
+	isNameStart := func(r rune) bool {
+		return unicode.IsLetter(r) || r == '_'
+	}
+	isNameChar := func(r rune) bool {
+		return isNameStart(r) || unicode.IsDigit(r) || r == '-' || r == '.'
+	}
+
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(rs) && rs[end] != r {
+				end++
+			}
+			if end == len(rs) {
+				return nil, fmt.Errorf("unterminated string literal")
+			}
+			toks = append(toks, xpathToken{"string", string(rs[i+1 : end])})
+			i = end + 1
+
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			end := i
+			for end < len(rs) && (unicode.IsDigit(rs[end]) || rs[end] == '.') {
+				end++
+			}
+			toks = append(toks, xpathToken{"number", string(rs[i:end])})
+			i = end
+
+		case isNameStart(r):
+			end := i
+			for end < len(rs) && isNameChar(rs[end]) {
+				end++
+			}
+			toks = append(toks, xpathToken{"name", string(rs[i:end])})
+			i = end
+
+		default:
+			// Two-character operators first.
+			if i+1 < len(rs) {
+				two := string(rs[i : i+2])
+				switch two {
+				case "//", "..", "::", "!=", "<=", ">=":
+					toks = append(toks, xpathToken{"op", two})
+					i += 2
+					continue
+				}
+			}
+
+			if strings.ContainsRune("/()[].@,|+-=<>*", r) {
+				toks = append(toks, xpathToken{"op", string(r)})
+				i++
+				continue
+			}
+			return nil, fmt.Errorf("unexpected character '%c'", r)
+		}
+	}
+
+	return toks, nil
+}
+
+// ------------------------------------------------------------------------
+// Parser
+
+type xpathParser struct {
+	toks []xpathToken
+	pos  int
+}
+
+func (p *xpathParser) done() bool {
+	return p.pos >= len(p.toks)
+}
+
+func (p *xpathParser) peek() xpathToken {
+	if p.done() {
+		return xpathToken{}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *xpathParser) peekAt(offset int) xpathToken {
+	if p.pos+offset >= len(p.toks) {
+		return xpathToken{}
+	}
+	return p.toks[p.pos+offset]
+}
+
+func (p *xpathParser) isOp(val string) bool {
+	t := p.peek()
+	return t.kind == "op" && t.val == val
+}
+
+func (p *xpathParser) expect(val string) error {
+	if !p.isOp(val) {
+		if p.done() {
+			return fmt.Errorf("expected '%s' but found end of expression", val)
+		}
+		return fmt.Errorf("expected '%s' but found '%s'", val, p.peek().val)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *xpathParser) parseExpr() (xpathExpr, error) {
+	return p.parseBinary(0)
+}
+
+// Binary operators, from lowest to highest precedence.
+var xpathPrecedence = [][]string{
+	{"or"},
+	{"and"},
+	{"=", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+}
+
+func (p *xpathParser) parseBinary(level int) (xpathExpr, error) {
+	if level == len(xpathPrecedence) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		matched := ""
+		for _, op := range xpathPrecedence[level] {
+			if (t.kind == "op" || t.kind == "name") && t.val == op {
+				matched = op
+			}
+		}
+		if matched == "" {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &xpathBinary{matched, left, right}
+	}
+}
+
+func (p *xpathParser) parseUnary() (xpathExpr, error) {
+	if p.isOp("-") {
+		p.pos++
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &xpathNegate{e}, nil
+	}
+	return p.parseUnion()
+}
+
+func (p *xpathParser) parseUnion() (xpathExpr, error) {
+	left, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp("|") {
+		p.pos++
+		right, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		left = &xpathUnion{left, right}
+	}
+	return left, nil
+}
+
+var xpathNodeTypes = map[string]bool{
+	"node":    true,
+	"text":    true,
+	"comment": true,
+}
+
+func (p *xpathParser) startsFilterExpr() bool {
+	t := p.peek()
+	switch t.kind {
+	case "string", "number":
+		return true
+	case "op":
+		return t.val == "("
+	case "name":
+		next := p.peekAt(1)
+		return next.kind == "op" && next.val == "(" && !xpathNodeTypes[t.val]
+	}
+	return false
+}
+
+func (p *xpathParser) parsePath() (xpathExpr, error) {
+	if !p.startsFilterExpr() {
+		return p.parseLocationPath()
+	}
+
+	primary, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	var preds []xpathExpr
+	for p.isOp("[") {
+		pred, err := p.parsePredicate()
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+
+	path := &xpathPath{filter: primary, filterPreds: preds}
+	if p.isOp("/") || p.isOp("//") {
+		if err = p.parseSteps(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(preds) == 0 && len(path.steps) == 0 {
+		return primary, nil
+	}
+	return path, nil
+}
+
+func (p *xpathParser) parseLocationPath() (xpathExpr, error) {
+	path := &xpathPath{}
+
+	if p.isOp("/") {
+		path.absolute = true
+		p.pos++
+
+		// A lone "/" selects the root.
+		if p.done() || !p.startsStep() {
+			return path, nil
+		}
+	} else if p.isOp("//") {
+		path.absolute = true
+		p.pos++
+		path.steps = append(path.steps, &xpathStep{axis: "descendant-or-self", test: "node()"})
+	}
+
+	step, err := p.parseStep()
+	if err != nil {
+		return nil, err
+	}
+	path.steps = append(path.steps, step)
+
+	if err = p.parseSteps(path); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
+
+// Parses any further "/step" or "//step" parts of a path.
+func (p *xpathParser) parseSteps(path *xpathPath) error {
+	for p.isOp("/") || p.isOp("//") {
+		if p.isOp("//") {
+			path.steps = append(path.steps, &xpathStep{axis: "descendant-or-self", test: "node()"})
+		}
+		p.pos++
+
+		step, err := p.parseStep()
+		if err != nil {
+			return err
+		}
+		path.steps = append(path.steps, step)
+	}
+	return nil
+}
+
+func (p *xpathParser) startsStep() bool {
+	t := p.peek()
+	if t.kind == "name" {
+		return true
+	}
+	return t.kind == "op" && (t.val == "." || t.val == ".." || t.val == "@" || t.val == "*")
+}
+
+var xpathAxes = map[string]bool{
+	"ancestor":           true,
+	"ancestor-or-self":   true,
+	"attribute":          true,
+	"child":              true,
+	"descendant":         true,
+	"descendant-or-self": true,
+	"following":          true,
+	"following-sibling":  true,
+	"parent":             true,
+	"preceding":          true,
+	"preceding-sibling":  true,
+	"self":               true,
+}
+
+func (p *xpathParser) parseStep() (*xpathStep, error) {
+	if p.isOp(".") {
+		p.pos++
+		return &xpathStep{axis: "self", test: "node()"}, nil
+	}
+	if p.isOp("..") {
+		p.pos++
+		return &xpathStep{axis: "parent", test: "node()"}, nil
+	}
+
+	step := &xpathStep{axis: "child"}
+	if p.isOp("@") {
+		p.pos++
+		step.axis = "attribute"
+	} else if t := p.peek(); t.kind == "name" && p.peekAt(1).val == "::" {
+		if !xpathAxes[t.val] {
+			return nil, fmt.Errorf("unknown axis '%s'", t.val)
+		}
+		step.axis = t.val
+		p.pos += 2
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == "op" && t.val == "*":
+		step.test = "*"
+		p.pos++
+	case t.kind == "name" && xpathNodeTypes[t.val] && p.peekAt(1).val == "(":
+		p.pos += 2
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		step.test = t.val + "()"
+	case t.kind == "name":
+		step.test = strings.ToLower(t.val)
+		p.pos++
+	case p.done():
+		return nil, fmt.Errorf("expected a step but found end of expression")
+	default:
+		return nil, fmt.Errorf("expected a step but found '%s'", t.val)
+	}
+
+	for p.isOp("[") {
+		pred, err := p.parsePredicate()
+		if err != nil {
+			return nil, err
+		}
+		step.preds = append(step.preds, pred)
+	}
+	return step, nil
+}
+
+func (p *xpathParser) parsePredicate() (xpathExpr, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expect("]"); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (p *xpathParser) parsePrimary() (xpathExpr, error) {
+	t := p.peek()
+	switch t.kind {
+	case "string":
+		p.pos++
+		return xpathLiteral{t.val}, nil
+
+	case "number":
+		p.pos++
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", t.val)
+		}
+		return xpathLiteral{f}, nil
+
+	case "op":
+		p.pos++
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+
+	// Function call.
+	fn, ok := xpathFunctions[t.val]
+	if !ok {
+		return nil, fmt.Errorf("unknown function '%s'", t.val)
+	}
+	p.pos += 2
+
+	call := &xpathCall{name: t.val, fn: fn}
+	for !p.isOp(")") {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.pos++
+
+	if len(call.args) < fn.minArgs || (fn.maxArgs >= 0 && len(call.args) > fn.maxArgs) {
+		return nil, fmt.Errorf("wrong number of arguments to %s()", t.val)
+	}
+	return call, nil
+}
+
+// ------------------------------------------------------------------------
+// Evaluation
+
+type xpathContext struct {
+	node      *html.Node
+	pos, size int
+}
+
+// Values are one of []*html.Node, string, float64 or bool.
+type xpathExpr interface {
+	eval(ctx *xpathContext) interface{}
+}
+
+type xpathLiteral struct {
+	val interface{}
+}
+
+func (e xpathLiteral) eval(ctx *xpathContext) interface{} {
+	return e.val
+}
+
+type xpathNegate struct {
+	e xpathExpr
+}
+
+func (e *xpathNegate) eval(ctx *xpathContext) interface{} {
+	return -xpathNumber(e.e.eval(ctx))
+}
+
+type xpathUnion struct {
+	left, right xpathExpr
+}
+
+func (e *xpathUnion) eval(ctx *xpathContext) interface{} {
+	l, lok := e.left.eval(ctx).([]*html.Node)
+	r, rok := e.right.eval(ctx).([]*html.Node)
+	if !lok || !rok {
+		return []*html.Node{}
+	}
+	return xpathDocumentOrder(append(append([]*html.Node{}, l...), r...))
+}
+
+type xpathBinary struct {
+	op          string
+	left, right xpathExpr
+}
+
+func (e *xpathBinary) eval(ctx *xpathContext) interface{} {
+	switch e.op {
+	case "or":
+		return xpathBoolean(e.left.eval(ctx)) || xpathBoolean(e.right.eval(ctx))
+	case "and":
+		return xpathBoolean(e.left.eval(ctx)) && xpathBoolean(e.right.eval(ctx))
+	case "+":
+		return xpathNumber(e.left.eval(ctx)) + xpathNumber(e.right.eval(ctx))
+	case "-":
+		return xpathNumber(e.left.eval(ctx)) - xpathNumber(e.right.eval(ctx))
+	}
+	return xpathCompare(e.op, e.left.eval(ctx), e.right.eval(ctx))
+}
+
+// Compares two values following the XPath rules: node-sets compare true if
+// any of their nodes' string-values satisfy the comparison.
+func xpathCompare(op string, a, b interface{}) bool {
+	if ns, ok := a.([]*html.Node); ok {
+		for _, n := range ns {
+			if xpathCompare(op, xpathStringValue(n), b) {
+				return true
+			}
+		}
+		return false
+	}
+	if ns, ok := b.([]*html.Node); ok {
+		for _, n := range ns {
+			if xpathCompare(op, a, xpathStringValue(n)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if op == "=" || op == "!=" {
+		var eq bool
+		_, aBool := a.(bool)
+		_, bBool := b.(bool)
+		_, aNum := a.(float64)
+		_, bNum := b.(float64)
+
+		switch {
+		case aBool || bBool:
+			eq = xpathBoolean(a) == xpathBoolean(b)
+		case aNum || bNum:
+			eq = xpathNumber(a) == xpathNumber(b)
+		default:
+			eq = xpathString(a) == xpathString(b)
+		}
+		return eq == (op == "=")
+	}
+
+	x, y := xpathNumber(a), xpathNumber(b)
+	switch op {
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	}
+	return false
+}
+
+type xpathPath struct {
+	// Either the path starts at the root, or at the result of a filter
+	// expression, or (if neither) at the context node.
+	absolute    bool
+	filter      xpathExpr
+	filterPreds []xpathExpr
+	steps       []*xpathStep
+}
+
+func (e *xpathPath) eval(ctx *xpathContext) interface{} {
+	var nodes []*html.Node
+	switch {
+	case e.absolute:
+		root := ctx.node
+		for root.Parent != nil {
+			root = root.Parent
+		}
+		nodes = []*html.Node{root}
+
+	case e.filter != nil:
+		ns, ok := e.filter.eval(ctx).([]*html.Node)
+		if !ok {
+			return []*html.Node{}
+		}
+		nodes = xpathFilter(ns, e.filterPreds)
+
+	default:
+		nodes = []*html.Node{ctx.node}
+	}
+
+	for _, step := range e.steps {
+		var next []*html.Node
+		for _, n := range nodes {
+			next = append(next, step.apply(n)...)
+		}
+		nodes = xpathDocumentOrder(next)
+	}
+	return nodes
+}
+
+type xpathStep struct {
+	axis  string
+	test  string
+	preds []xpathExpr
+}
+
+func (s *xpathStep) apply(n *html.Node) []*html.Node {
+	var candidates []*html.Node
+	for _, c := range xpathAxis(s.axis, n) {
+		if s.matches(c) {
+			candidates = append(candidates, c)
+		}
+	}
+	return xpathFilter(candidates, s.preds)
+}
+
+func (s *xpathStep) matches(n *html.Node) bool {
+	switch s.test {
+	case "node()":
+		return true
+	case "text()":
+		return n.Type == html.TextNode
+	case "comment()":
+		return n.Type == html.CommentNode
+	}
+
+	// Name tests match the principal node type of the axis.
+	if s.axis == "attribute" {
+		return n.Type == attributeNode && (s.test == "*" || strings.ToLower(n.Attr[0].Key) == s.test)
+	}
+	return n.Type == html.ElementNode && (s.test == "*" || n.Data == s.test)
+}
+
+// Applies predicates in turn, each relative to the output of the last.
+func xpathFilter(nodes []*html.Node, preds []xpathExpr) []*html.Node {
+	for _, pred := range preds {
+		var kept []*html.Node
+		for i, n := range nodes {
+			ctx := &xpathContext{node: n, pos: i + 1, size: len(nodes)}
+			v := pred.eval(ctx)
+			if f, ok := v.(float64); ok {
+				if f == float64(ctx.pos) {
+					kept = append(kept, n)
+				}
+			} else if xpathBoolean(v) {
+				kept = append(kept, n)
+			}
+		}
+		nodes = kept
+	}
+	return nodes
+}
+
+// Returns the nodes along the given axis, in axis order (i.e. reverse
+// document order for the reverse axes).
+func xpathAxis(axis string, n *html.Node) []*html.Node {
+	var ret []*html.Node
+
+	var descendants func(*html.Node)
+	descendants = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			ret = append(ret, c)
+			descendants(c)
+		}
+	}
+
+	switch axis {
+	case "self":
+		ret = append(ret, n)
+	case "child":
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			ret = append(ret, c)
+		}
+	case "descendant":
+		descendants(n)
+	case "descendant-or-self":
+		ret = append(ret, n)
+		descendants(n)
+	case "parent":
+		if n.Parent != nil {
+			ret = append(ret, n.Parent)
+		}
+	case "ancestor", "ancestor-or-self":
+		if axis == "ancestor-or-self" {
+			ret = append(ret, n)
+		}
+		for p := n.Parent; p != nil; p = p.Parent {
+			ret = append(ret, p)
+		}
+	case "following-sibling":
+		if n.Type != attributeNode {
+			for s := n.NextSibling; s != nil; s = s.NextSibling {
+				ret = append(ret, s)
+			}
+		}
+	case "preceding-sibling":
+		if n.Type != attributeNode {
+			for s := n.PrevSibling; s != nil; s = s.PrevSibling {
+				ret = append(ret, s)
+			}
+		}
+	case "following":
+		start := n
+		if n.Type == attributeNode {
+			start = n.Parent
+			descendants(start)
+		}
+		for p := start; p != nil; p = p.Parent {
+			for s := p.NextSibling; s != nil; s = s.NextSibling {
+				ret = append(ret, s)
+				descendants(s)
+			}
+		}
+	case "preceding":
+		start := n
+		if n.Type == attributeNode {
+			start = n.Parent
+		}
+		ancestors := make(map[*html.Node]bool)
+		for p := start.Parent; p != nil; p = p.Parent {
+			ancestors[p] = true
+		}
+		root := start
+		for root.Parent != nil {
+			root = root.Parent
+		}
+
+		// Everything before start in document order, except ancestors.
+		var all []*html.Node
+		var walk func(*html.Node) bool
+		walk = func(c *html.Node) bool {
+			if c == start {
+				return true
+			}
+			if !ancestors[c] {
+				all = append(all, c)
+			}
+			for cc := c.FirstChild; cc != nil; cc = cc.NextSibling {
+				if walk(cc) {
+					return true
+				}
+			}
+			return false
+		}
+		walk(root)
+		for i := len(all) - 1; i >= 0; i-- {
+			ret = append(ret, all[i])
+		}
+	case "attribute":
+		if n.Type == html.ElementNode {
+			for _, a := range n.Attr {
+				ret = append(ret, &html.Node{
+					Type:   attributeNode,
+					Parent: n,
+					Attr:   []html.Attribute{a},
+				})
+			}
+		}
+	}
+	return ret
+}
+
+// Sorts nodes into document order and removes duplicates.  Attribute nodes
+// are freshly created each time they're selected, so they're compared by
+// their parent and name.
+func xpathDocumentOrder(nodes []*html.Node) []*html.Node {
+	if len(nodes) < 2 {
+		return nodes
+	}
+
+	root := nodes[0]
+	for root.Parent != nil {
+		root = root.Parent
+	}
+
+	order := make(map[*html.Node]int)
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		order[n] = len(order)
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+
+	seen := make(map[xpathNodeKey]bool)
+	var unique []*html.Node
+	for _, n := range nodes {
+		k := xpathKeyOf(n)
+		if !seen[k] {
+			seen[k] = true
+			unique = append(unique, n)
+		}
+	}
+
+	sort.Stable(xpathByOrder{unique, order})
+	return unique
+}
+
+type xpathNodeKey struct {
+	node *html.Node
+	attr string
+}
+
+func xpathKeyOf(n *html.Node) xpathNodeKey {
+	if n.Type == attributeNode {
+		return xpathNodeKey{n.Parent, n.Attr[0].Key}
+	}
+	return xpathNodeKey{n, ""}
+}
+
+// Sorts nodes by their position in the document.  An element comes before
+// its attributes.
+type xpathByOrder struct {
+	nodes []*html.Node
+	order map[*html.Node]int
+}
+
+func (s xpathByOrder) Len() int      { return len(s.nodes) }
+func (s xpathByOrder) Swap(i, j int) { s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i] }
+func (s xpathByOrder) Less(i, j int) bool {
+	ki, kj := xpathKeyOf(s.nodes[i]), xpathKeyOf(s.nodes[j])
+	if ki.node != kj.node {
+		return s.order[ki.node] < s.order[kj.node]
+	}
+	return ki.attr < kj.attr
+}
+
+// ------------------------------------------------------------------------
+// Type conversions
+
+func xpathString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case float64:
+		if math.IsNaN(v) {
+			return "NaN"
+		}
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []*html.Node:
+		if len(v) == 0 {
+			return ""
+		}
+		return xpathStringValue(v[0])
+	}
+	return ""
+}
+
+func xpathNumber(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(xpathString(v)), 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return f
+}
+
+func xpathBoolean(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return len(v) > 0
+	case []*html.Node:
+		return len(v) > 0
+	}
+	return false
+}
+
+// ------------------------------------------------------------------------
+// Functions
+
+type xpathFunction struct {
+	minArgs, maxArgs int // maxArgs of -1 means unlimited
+	call             func(ctx *xpathContext, args []interface{}) interface{}
+}
+
+type xpathCall struct {
+	name string
+	fn   xpathFunction
+	args []xpathExpr
+}
+
+func (e *xpathCall) eval(ctx *xpathContext) interface{} {
+	args := make([]interface{}, len(e.args))
+	for i, a := range e.args {
+		args[i] = a.eval(ctx)
+	}
+	return e.fn.call(ctx, args)
+}
+
+// Returns the first argument as a string, or the context node's
+// string-value if there isn't one.
+func xpathStringArg(ctx *xpathContext, args []interface{}) string {
+	if len(args) == 0 {
+		return xpathStringValue(ctx.node)
+	}
+	return xpathString(args[0])
+}
+
+var xpathFunctions map[string]xpathFunction
+
+func init() {
+	xpathFunctions = map[string]xpathFunction{
+		"last": {0, 0, func(ctx *xpathContext, args []interface{}) interface{} {
+			return float64(ctx.size)
+		}},
+		"position": {0, 0, func(ctx *xpathContext, args []interface{}) interface{} {
+			return float64(ctx.pos)
+		}},
+		"count": {1, 1, func(ctx *xpathContext, args []interface{}) interface{} {
+			ns, _ := args[0].([]*html.Node)
+			return float64(len(ns))
+		}},
+		"name": {0, 1, func(ctx *xpathContext, args []interface{}) interface{} {
+			n := ctx.node
+			if len(args) > 0 {
+				ns, _ := args[0].([]*html.Node)
+				if len(ns) == 0 {
+					return ""
+				}
+				n = ns[0]
+			}
+			switch n.Type {
+			case html.ElementNode:
+				return n.Data
+			case attributeNode:
+				return n.Attr[0].Key
+			}
+			return ""
+		}},
+		"string": {0, 1, func(ctx *xpathContext, args []interface{}) interface{} {
+			return xpathStringArg(ctx, args)
+		}},
+		"concat": {2, -1, func(ctx *xpathContext, args []interface{}) interface{} {
+			var parts []string
+			for _, a := range args {
+				parts = append(parts, xpathString(a))
+			}
+			return strings.Join(parts, "")
+		}},
+		"contains": {2, 2, func(ctx *xpathContext, args []interface{}) interface{} {
+			return strings.Contains(xpathString(args[0]), xpathString(args[1]))
+		}},
+		"starts-with": {2, 2, func(ctx *xpathContext, args []interface{}) interface{} {
+			return strings.HasPrefix(xpathString(args[0]), xpathString(args[1]))
+		}},
+		"string-length": {0, 1, func(ctx *xpathContext, args []interface{}) interface{} {
+			return float64(len([]rune(xpathStringArg(ctx, args))))
+		}},
+		"normalize-space": {0, 1, func(ctx *xpathContext, args []interface{}) interface{} {
+			return strings.Join(strings.Fields(xpathStringArg(ctx, args)), " ")
+		}},
+		"substring-before": {2, 2, func(ctx *xpathContext, args []interface{}) interface{} {
+			s, sep := xpathString(args[0]), xpathString(args[1])
+			if i := strings.Index(s, sep); i != -1 {
+				return s[:i]
+			}
+			return ""
+		}},
+		"substring-after": {2, 2, func(ctx *xpathContext, args []interface{}) interface{} {
+			s, sep := xpathString(args[0]), xpathString(args[1])
+			if i := strings.Index(s, sep); i != -1 {
+				return s[i+len(sep):]
+			}
+			return ""
+		}},
+		"not": {1, 1, func(ctx *xpathContext, args []interface{}) interface{} {
+			return !xpathBoolean(args[0])
+		}},
+		"true": {0, 0, func(ctx *xpathContext, args []interface{}) interface{} {
+			return true
+		}},
+		"false": {0, 0, func(ctx *xpathContext, args []interface{}) interface{} {
+			return false
+		}},
+		"number": {0, 1, func(ctx *xpathContext, args []interface{}) interface{} {
+			if len(args) == 0 {
+				return xpathNumber(xpathStringValue(ctx.node))
+			}
+			return xpathNumber(args[0])
+		}},
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/html"
+)
+
+const xpathTestDoc = `<html><body>
+<div id="main" class="content">
+  <h1>Title</h1>
+  <ul>
+    <li class="item">One</li>
+    <li class="item sale">Two <b>bold</b></li>
+    <li>Three</li>
+  </ul>
+  <a href="/a">First</a><a href="/b">Second</a>
+  <p>Price: <span>12.50</span></p>
+  <!--note-->
+</div>
+<div id="footer">Footer</div>
+</body></html>`
+
+func TestXPathSelect(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(xpathTestDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"//h1", []string{"Title"}},
+		{"//li", []string{"One", "Two bold", "Three"}},
+		{"//li[1]", []string{"One"}},
+		{"//li[last()]", []string{"Three"}},
+		{"//li[position() > 1]", []string{"Two bold", "Three"}},
+		{"//li[@class]", []string{"One", "Two bold"}},
+		{"//li[@class='item']", []string{"One"}},
+		{"//li[contains(@class, 'sale')]", []string{"Two bold"}},
+		{"//li[not(@class)]", []string{"Three"}},
+		{"//li[b]", []string{"Two bold"}},
+		{"//a/@href", []string{"/a", "/b"}},
+		{"//a[@href='/b']/text()", []string{"Second"}},
+		{"//div[@id='main']/h1", []string{"Title"}},
+		{"/html/body/div[2]", []string{"Footer"}},
+		{"//b/ancestor::li", []string{"Two bold"}},
+		{"//b/..", []string{"Two bold"}},
+		{"//li[1]/following-sibling::li", []string{"Two bold", "Three"}},
+		{"//li[3]/preceding-sibling::li", []string{"One", "Two bold"}},
+		{"//h1 | //div[@id='footer']", []string{"Title", "Footer"}},
+		{"//div[@id='footer'] | //h1", []string{"Title", "Footer"}},
+		{"//span[number(.) > 10]", []string{"12.50"}},
+		{"//span[. = 12.5]", []string{"12.50"}},
+		{"//p[starts-with(normalize-space(.), 'Price')]/span", []string{"12.50"}},
+		{"//ul[count(li) = 3]/li[2]/b", []string{"bold"}},
+		{"//div[@id='main']/comment()", []string{"note"}},
+		{"//li[@class='item' or not(@class)]", []string{"One", "Three"}},
+		{"//li[@class and contains(., 'Two')]", []string{"Two bold"}},
+		{"//table", []string{}},
+	}
+
+	for _, tt := range tests {
+		x, err := CompileXPath(tt.expr)
+		if err != nil {
+			t.Errorf("CompileXPath(%q) returned error: %v", tt.expr, err)
+			continue
+		}
+		nodes, err := x.Select(root)
+		if err != nil {
+			t.Errorf("Select(%q) returned error: %v", tt.expr, err)
+			continue
+		}
+
+		got := []string{}
+		for _, n := range nodes {
+			got = append(got, strings.Join(strings.Fields(xpathStringValue(n)), " "))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Select(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestXPathInvalid(t *testing.T) {
+	root, err := html.Parse(strings.NewReader(xpathTestDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expr := range []string{
+		"",
+		"//li[",
+		"//li]",
+		"//li[@class='item]",
+		"//li/unknown::b",
+		"//li[nosuchfunction()]",
+		"//li[count()]",
+		"//li)",
+	} {
+		if _, err := CompileXPath(expr); err == nil {
+			t.Errorf("CompileXPath(%q) succeeded, want an error", expr)
+		}
+	}
+
+	// Valid expressions that don't return a node-set can't be selected.
+	for _, expr := range []string{"count(//li)", "'text'", "1 + 2"} {
+		x, err := CompileXPath(expr)
+		if err != nil {
+			t.Errorf("CompileXPath(%q) returned error: %v", expr, err)
+			continue
+		}
+		if _, err := x.Select(root); err == nil {
+			t.Errorf("Select(%q) succeeded, want an error", expr)
+		}
+	}
+}